@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// valid values of the access_log format setting
+const (
+	accessLogFormatJSON     = "json"
+	accessLogFormatCombined = "combined"
+)
+
+// AccessLogConfig configures the access log
+type AccessLogConfig struct {
+	File   string `yaml:"file" json:"file"`     // path of the access log, or "-" for stdout; the access log is disabled if empty
+	Format string `yaml:"format" json:"format"` // "json" (JSON lines, the default) or "combined" (Apache combined log format)
+}
+
+// AccessLogEntry is one line of the access log; the fields describing how
+// the request was handled are filled in by the handlers
+type AccessLogEntry struct {
+	Time        time.Time `json:"time"`
+	ClientIP    string    `json:"client_ip"`
+	Identity    string    `json:"identity,omitempty"` // the authenticated client, see Identity.String
+	Method      string    `json:"method"`
+	Path        string    `json:"path"`
+	Proxy       string    `json:"proxy,omitempty"`        // the LocalPrefix of the ProxyItem which handled the request
+	UpstreamURL string    `json:"upstream_url,omitempty"` // the URL of the request made to the upstream registry or token service
+	Status      int       `json:"status"`
+	Bytes       int64     `json:"bytes"`
+	Duration    float64   `json:"duration"` // in seconds
+	Digest      string    `json:"digest,omitempty"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	Referer     string    `json:"-"`
+	Protocol    string    `json:"-"`
+}
+
+type accessLogKey struct{}
+
+// AccessLogEntryFrom returns the access log entry of the request with the
+// given context; if the access log is disabled a throwaway entry is returned
+// so callers never need to check
+func AccessLogEntryFrom(ctx context.Context) *AccessLogEntry {
+	if entry, ok := ctx.Value(accessLogKey{}).(*AccessLogEntry); ok {
+		return entry
+	}
+	return &AccessLogEntry{}
+}
+
+// AccessLog writes an access log line for every client request
+type AccessLog struct {
+	Format string
+
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+// NewAccessLog opens the access log described by the given configuration, it
+// returns nil if the access log is disabled
+func NewAccessLog(cfg AccessLogConfig) (*AccessLog, error) {
+	if cfg.File == "" {
+		return nil, nil
+	}
+	al := &AccessLog{Format: cfg.Format, writer: os.Stdout}
+	if cfg.File != "-" {
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+		if err != nil {
+			return nil, fmt.Errorf("NewAccessLog: unable to open access log; error: %w", err)
+		}
+		al.writer = f
+	}
+	logger.Info("writing access log", "file", cfg.File, "format", cfg.Format)
+	return al, nil
+}
+
+// Wrap returns a handler which logs the requests served by the given
+// handler; a nil AccessLog returns the handler unchanged
+func (al *AccessLog) Wrap(next http.Handler) http.Handler {
+	if al == nil {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			clientIP = req.RemoteAddr
+		}
+		entry := &AccessLogEntry{
+			Time:      start,
+			ClientIP:  clientIP,
+			Method:    req.Method,
+			Path:      req.URL.RequestURI(),
+			UserAgent: req.UserAgent(),
+			Referer:   req.Referer(),
+			Protocol:  req.Proto,
+		}
+		recorder := &accessLogWriter{ResponseWriter: rw, status: http.StatusOK}
+		defer func() {
+			entry.Status = recorder.status
+			entry.Bytes = recorder.bytes
+			entry.Duration = time.Since(start).Seconds()
+			al.write(entry)
+		}()
+		next.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), accessLogKey{}, entry)))
+	})
+}
+
+// Close closes the access log file; entries written afterwards, e.g. by
+// requests which outlast a shutdown, are dropped. A nil AccessLog or one
+// writing to stdout has nothing to close.
+func (al *AccessLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	f, ok := al.writer.(*os.File)
+	al.writer = io.Discard
+	if !ok || f == os.Stdout {
+		return nil
+	}
+	return f.Close()
+}
+
+// write formats the entry and appends it to the access log
+func (al *AccessLog) write(entry *AccessLogEntry) {
+	var line []byte
+	if al.Format == accessLogFormatCombined {
+		line = []byte(entry.Combined() + "\n")
+	} else {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			logger.Error("AccessLog.write: unable to marshal access log entry", "error", err)
+			return
+		}
+		line = append(data, '\n')
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if _, err := al.writer.Write(line); err != nil {
+		logger.Error("AccessLog.write: unable to write access log", "error", err)
+	}
+}
+
+// Combined returns the entry in Apache combined log format, followed by the
+// proxy, upstream URL, digest and duration
+func (entry *AccessLogEntry) Combined() string {
+	dash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(dash(s), `"`, `\"`) + `"`
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %d %s %s proxy=%s upstream=%s digest=%s duration=%.3f`,
+		entry.ClientIP,
+		dash(strings.ReplaceAll(entry.Identity, " ", "_")),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method,
+		entry.Path,
+		entry.Protocol,
+		entry.Status,
+		entry.Bytes,
+		quote(entry.Referer),
+		quote(entry.UserAgent),
+		quote(entry.Proxy),
+		quote(entry.UpstreamURL),
+		quote(entry.Digest),
+		entry.Duration,
+	)
+}
+
+// accessLogWriter records the status and size of a response
+type accessLogWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int64
+	wroteHeader bool
+}
+
+func (w *accessLogWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter,
+// which the reverse proxies use to flush streamed responses
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newAccessLogServer starts a proxy for the given configuration which logs
+// its requests in the given format; the returned function waits for the
+// access log to have n lines and returns them
+func newAccessLogServer(t *testing.T, format, configYAML string) (*httptest.Server, func(n int) []string) {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	accessLog := &AccessLog{Format: format, writer: buffer}
+	front := httptest.NewServer(accessLog.Wrap(newTestHandler(t, configYAML)))
+	t.Cleanup(front.Close)
+
+	// the line is written once the handler has returned, which may be after
+	// the client has received the response
+	lines := func(n int) []string {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			accessLog.mu.Lock()
+			logged := strings.Split(strings.TrimSuffix(buffer.String(), "\n"), "\n")
+			accessLog.mu.Unlock()
+			if len(logged) >= n && logged[0] != "" {
+				return logged
+			}
+		}
+		t.Fatalf("access log doesn't have %d lines", n)
+		return nil
+	}
+	return front, lines
+}
+
+// accessLogTestSetup returns the configuration of a proxy "a/" for the
+// manifest upstream, which alice may log in to
+func accessLogTestSetup(t *testing.T, upstream *testManifestUpstream) string {
+	t.Helper()
+	htpasswd := writeTestFile(t, "htpasswd", htpasswdLine(t, "alice", "alice-secret"))
+	return "htpasswd: " + htpasswd + "\nproxies:\n" + proxyYAML("a/", upstream.testUpstream, "org", "users: [alice]")
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2}`)
+	front, lines := newAccessLogServer(t, accessLogFormatJSON, accessLogTestSetup(t, upstream))
+
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "alice", "alice-secret")
+	doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", token)
+	logged := lines(2)
+
+	var tokenEntry, manifestEntry AccessLogEntry
+	if err := json.Unmarshal([]byte(logged[0]), &tokenEntry); err != nil {
+		t.Fatalf("token request line %q: %v", logged[0], err)
+	}
+	if err := json.Unmarshal([]byte(logged[1]), &manifestEntry); err != nil {
+		t.Fatalf("manifest request line %q: %v", logged[1], err)
+	}
+
+	if tokenEntry.Identity != "alice" || tokenEntry.Proxy != "a/" || tokenEntry.Status != http.StatusOK ||
+		!strings.HasPrefix(tokenEntry.UpstreamURL, upstream.URL+"/token?") || !strings.HasPrefix(tokenEntry.Path, "/_token?") {
+		t.Errorf("token request logged as %s", logged[0])
+	}
+	want := AccessLogEntry{
+		ClientIP:    "127.0.0.1",
+		Identity:    "alice",
+		Method:      http.MethodGet,
+		Path:        "/v2/a/app/manifests/latest",
+		Proxy:       "a/",
+		UpstreamURL: upstream.URL + "/v2/org/app/manifests/latest",
+		Status:      http.StatusOK,
+		Bytes:       int64(len(upstream.manifest)),
+		Digest:      upstream.digest,
+		UserAgent:   "Go-http-client/1.1",
+	}
+	got := manifestEntry
+	got.Time, got.Duration = time.Time{}, 0
+	if got != want {
+		t.Errorf("manifest request logged as %s\nwant %+v", logged[1], want)
+	}
+	if time.Since(manifestEntry.Time) > time.Minute || manifestEntry.Duration <= 0 {
+		t.Errorf("manifest request logged with time %v and duration %v", manifestEntry.Time, manifestEntry.Duration)
+	}
+}
+
+func TestAccessLogCombined(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2}`)
+	front, lines := newAccessLogServer(t, accessLogFormatCombined, accessLogTestSetup(t, upstream))
+
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "alice", "alice-secret")
+	doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", token)
+	line := lines(2)[1]
+
+	prefix := "127.0.0.1 - alice ["
+	request := fmt.Sprintf(`] "GET /v2/a/app/manifests/latest HTTP/1.1" 200 %d "-" "Go-http-client/1.1" proxy="a/" upstream="%s/v2/org/app/manifests/latest" digest="%s" duration=`,
+		len(upstream.manifest), upstream.URL, upstream.digest)
+	if !strings.HasPrefix(line, prefix) || !strings.Contains(line, request) {
+		t.Errorf("manifest request logged as\n%s\nwant\n%s...%s", line, prefix, request)
+	}
+}
+
+func TestNewAccessLog(t *testing.T) {
+	if al, err := NewAccessLog(AccessLogConfig{}); al != nil || err != nil {
+		t.Errorf("NewAccessLog() without a file = %v, %v; want it disabled", al, err)
+	}
+	if al, err := NewAccessLog(AccessLogConfig{File: "-", Format: accessLogFormatJSON}); err != nil || al == nil || al.writer != os.Stdout {
+		t.Errorf(`NewAccessLog() with file "-" doesn't write to stdout; error: %v`, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "access.log")
+	al, err := NewAccessLog(AccessLogConfig{File: path, Format: accessLogFormatCombined})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { al.writer.(*os.File).Close() }) //nolint
+	al.write(&AccessLogEntry{ClientIP: "192.0.2.1", Method: http.MethodGet, Path: "/v2/", Protocol: "HTTP/1.1", Status: http.StatusOK})
+	if data, _ := os.ReadFile(path); !strings.HasPrefix(string(data), `192.0.2.1 - - [`) || !strings.HasSuffix(string(data), "\n") {
+		t.Errorf("access log file contains %q", data)
+	}
+}
+
+func TestAccessLogClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	accessLog, err := NewAccessLog(AccessLogConfig{File: path, Format: accessLogFormatCombined})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := accessLog.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/before", nil))
+	if err := accessLog.Close(); err != nil {
+		t.Fatalf("Close() error %v", err)
+	}
+	// requests outlasting the shutdown are dropped from the closed log
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/after", nil))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "/before") || strings.Contains(string(data), "/after") {
+		t.Errorf("access log %q, want only the request before closing", data)
+	}
+	if err := (*AccessLog)(nil).Close(); err != nil {
+		t.Errorf("Close() of a disabled access log error %v", err)
+	}
+}
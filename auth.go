@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// errInvalidCredentials is returned when a client presents credentials which
+// can't be verified
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// Identity describes a client which authenticated to the token endpoint
+type Identity struct {
+	Name   string         // the htpasswd username, or the "sub" claim of an OIDC token
+	Issuer string         // the issuer of the OIDC token; empty for htpasswd users
+	Claims map[string]any // the claims of the OIDC token; nil for htpasswd users
+}
+
+// String returns a name for the identity, suitable for logs and the subject
+// of the tokens we issue
+func (id *Identity) String() string {
+	if id == nil {
+		return ""
+	}
+	if id.Issuer != "" {
+		return fmt.Sprintf("%s@%s", id.Name, id.Issuer)
+	}
+	return id.Name
+}
+
+// Authenticator verifies the credentials clients present to the token
+// endpoint and decides which proxies they may receive tokens for
+type Authenticator struct {
+	users     map[string][]byte        // username -> bcrypt password hash
+	groups    map[string][]string      // group name -> usernames
+	verifiers map[string]*OIDCVerifier // OIDC issuer -> verifier
+}
+
+// NewAuthenticator returns an Authenticator for the users and groups in the
+// given configuration
+func NewAuthenticator(cfg Config) (*Authenticator, error) {
+	auth := &Authenticator{
+		users:     map[string][]byte{},
+		groups:    cfg.Groups,
+		verifiers: map[string]*OIDCVerifier{},
+	}
+	if cfg.HtpasswdFile != "" {
+		users, err := LoadHtpasswd(cfg.HtpasswdFile)
+		if err != nil {
+			return nil, err
+		}
+		auth.users = users
+	}
+	for _, provider := range cfg.OIDC {
+		verifier, err := NewOIDCVerifier(provider)
+		if err != nil {
+			return nil, err
+		}
+		auth.verifiers[provider.Issuer] = verifier
+	}
+	return auth, nil
+}
+
+// LoadHtpasswd reads an htpasswd file and returns a map of usernames to
+// password hashes; only bcrypt hashes (as written by `htpasswd -B`) are
+// supported, entries using other hash types are skipped
+func LoadHtpasswd(path string) (map[string][]byte, error) {
+	logger.Info("loading htpasswd file", "file", path)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("LoadHtpasswd: unable to open htpasswd file; error: %w", err)
+	}
+	defer f.Close() //nolint
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("LoadHtpasswd: malformed entry on line %d of %s", lineNumber, path)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			logger.Warn("LoadHtpasswd: skipping entry which doesn't use bcrypt", "user", username, "line", lineNumber)
+			continue
+		}
+		users[username] = []byte(hash)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("LoadHtpasswd: unable to read htpasswd file; error: %w", err)
+	}
+	return users, nil
+}
+
+// Authenticate checks the credentials in the request's Authorization header;
+// clients may send an htpasswd username and password, or an OIDC ID token
+// either as the password of Basic credentials or as a Bearer token. It
+// returns nil if the request didn't carry any credentials.
+func (a *Authenticator) Authenticate(req *http.Request) (*Identity, error) {
+	authHeader := req.Header.Get("Authorization")
+	if authHeader == "" {
+		return nil, nil
+	}
+	if bearer, ok := strings.CutPrefix(authHeader, "Bearer "); ok {
+		if !LooksLikeJWT(bearer) {
+			return nil, errInvalidCredentials
+		}
+		return a.authenticateJWT(bearer)
+	}
+
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+	if hash, found := a.users[username]; found {
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+			return nil, errInvalidCredentials
+		}
+		return &Identity{Name: username}, nil
+	}
+	if LooksLikeJWT(password) {
+		return a.authenticateJWT(password)
+	}
+	return nil, errInvalidCredentials
+}
+
+// authenticateJWT verifies the given OIDC ID token with the verifier for
+// the issuer named in the token
+func (a *Authenticator) authenticateJWT(raw string) (*Identity, error) {
+	token, err := jwt.ParseSigned(raw, jwtSignatureAlgorithms)
+	if err != nil {
+		tokenLogger.Debug("Authenticator.authenticateJWT: unable to parse token", "error", err)
+		return nil, errInvalidCredentials
+	}
+	var unverified jwt.Claims
+	if err := token.UnsafeClaimsWithoutVerification(&unverified); err != nil {
+		tokenLogger.Debug("Authenticator.authenticateJWT: unable to read token claims", "error", err)
+		return nil, errInvalidCredentials
+	}
+	verifier, ok := a.verifiers[unverified.Issuer]
+	if !ok {
+		tokenLogger.Debug("Authenticator.authenticateJWT: token from unknown issuer", "issuer", unverified.Issuer)
+		return nil, errInvalidCredentials
+	}
+	claims, err := verifier.Verify(token)
+	if err != nil {
+		tokenLogger.Debug("Authenticator.authenticateJWT: token verification failed", "issuer", unverified.Issuer, "error", err)
+		return nil, errInvalidCredentials
+	}
+	subject, _ := claims["sub"].(string)
+	return &Identity{Name: subject, Issuer: unverified.Issuer, Claims: claims}, nil
+}
+
+// Authorized returns true if the given identity (which is nil for anonymous
+// clients) may receive tokens for the given proxy
+func (a *Authenticator) Authorized(id *Identity, proxy ProxyItem) bool {
+	if !proxy.RequiresAuth() {
+		return true
+	}
+	return a.Allowed(id, proxy.Users, proxy.Groups, proxy.Claims)
+}
+
+// Allowed returns true if the given identity is one of the users, a member
+// of one of the groups, or (for OIDC identities) matches one of the claim
+// rules
+func (a *Authenticator) Allowed(id *Identity, users, groups []string, claims []ClaimRule) bool {
+	if id == nil {
+		return false
+	}
+	if id.Issuer != "" {
+		for _, rule := range claims {
+			// the same claims may mean something else at another issuer
+			if rule.Issuer() == id.Issuer && rule.Matches(id.Claims) {
+				return true
+			}
+		}
+		return false
+	}
+	if slices.Contains(users, id.Name) {
+		return true
+	}
+	for _, group := range groups {
+		if slices.Contains(a.groups[group], id.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicChallenge returns a RegistryError asking the client to authenticate
+// with a username and password
+func BasicChallenge(fqdn, message string) *RegistryError {
+	regErr := NewRegistryError(http.StatusUnauthorized, errCodeUnauthorized, message)
+	regErr.Challenge = WWWAuthenticateData{Scheme: "Basic", Realm: fqdn}.String()
+	return regErr
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// htpasswdLine returns an htpasswd entry for the user with a bcrypt hash
+func htpasswdLine(t *testing.T, user, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user + ":" + string(hash) + "\n"
+}
+
+func TestHtpasswdFlow(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) //nolint
+	})
+	htpasswd := writeTestFile(t, "htpasswd",
+		htpasswdLine(t, "alice", "alice-secret")+htpasswdLine(t, "bob", "bob-secret")+htpasswdLine(t, "carol", "carol-secret"))
+	front := newTestServer(t, "htpasswd: "+htpasswd+"\n"+
+		"groups:\n  team: [bob]\n"+
+		"proxies:\n"+
+		proxyYAML("open/", upstream, "public")+
+		proxyYAML("private/", upstream, "private", "users: [alice]", "groups: [team]"))
+
+	tests := []struct {
+		name      string
+		scope     string
+		user      string
+		password  string
+		status    int
+		challenge string // prefix of the expected WWW-Authenticate header
+	}{
+		{"anonymous, open proxy", "repository:open/app:pull", "", "", http.StatusOK, ""},
+		{"anonymous, restricted proxy", "repository:private/app:pull", "", "", http.StatusUnauthorized, `Basic realm="reg.example.com"`},
+		{"listed user", "repository:private/app:pull", "alice", "alice-secret", http.StatusOK, ""},
+		{"group member", "repository:private/app:pull", "bob", "bob-secret", http.StatusOK, ""},
+		{"wrong password", "repository:private/app:pull", "alice", "bob-secret", http.StatusUnauthorized, "Basic "},
+		{"unknown user", "repository:private/app:pull", "mallory", "alice-secret", http.StatusUnauthorized, "Basic "},
+		{"user without access", "repository:private/app:pull", "carol", "carol-secret", http.StatusForbidden, ""},
+		{"wrong password, open proxy", "repository:open/app:pull", "alice", "bob-secret", http.StatusOK, ""},
+		{"one of the scopes is restricted", "repository:open/app:pull repository:private/app:pull", "carol", "carol-secret", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, front.URL+"/_token?service=reg.example.com&scope="+strings.ReplaceAll(tt.scope, " ", "+"), nil)
+			if tt.user != "" {
+				req.SetBasicAuth(tt.user, tt.password)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close() //nolint
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if challenge := resp.Header.Get("Www-Authenticate"); !strings.HasPrefix(challenge, tt.challenge) || (tt.challenge == "") != (challenge == "") {
+				t.Errorf("challenge %q, want %q", challenge, tt.challenge)
+			}
+		})
+	}
+
+	t.Run("anonymous registry request to a restricted proxy", func(t *testing.T) {
+		resp := doRequest(t, front, http.MethodGet, "/v2/private/app/manifests/latest", "")
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("status %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+		}
+		want := `Bearer realm="https://reg.example.com/_token",service="reg.example.com",scope="repository:private/app:pull"`
+		if challenge := resp.Header.Get("Www-Authenticate"); challenge != want {
+			t.Errorf("challenge %q, want %q", challenge, want)
+		}
+		if requests := upstream.Requests("/v2/private/app/manifests/latest"); len(requests) != 0 {
+			t.Errorf("request was forwarded upstream")
+		}
+
+		_, token := getToken(t, front, "scope=repository:private/app:pull", "alice", "alice-secret")
+		if resp := doRequest(t, front, http.MethodGet, "/v2/private/app/manifests/latest", token); resp.StatusCode != http.StatusOK {
+			t.Errorf("status with token %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+	})
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+// defaultCacheMaxSize is used when cache_dir is set without cache_max_size
+const defaultCacheMaxSize = "10GiB"
+
+// only sha256 digests are cached, blobs with other digests are always
+// streamed from upstream
+var cacheableDigestRegex = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+
+// BlobCache is a content-addressed on-disk cache of registry blobs with a
+// size-bounded least-recently-used eviction policy. Blobs are stored as
+// <Dir>/blobs/sha256/<hex digest>, and partially downloaded blobs are kept in
+// <Dir>/tmp until their digest has been verified.
+//
+// Like in distribution, a blob is only served for the repositories it was
+// fetched from upstream for; these are recorded as empty link files in
+// <Dir>/links/<repository key>/<hex digest>, see BlobCacheRepoKey.
+type BlobCache struct {
+	Dir     string
+	MaxSize int64
+
+	mu      sync.Mutex
+	size    int64                    // total size of the cached blobs
+	lru     *list.List               // of *blobCacheEntry; most recently used at the front
+	entries map[string]*list.Element // digest -> element in lru
+}
+
+type blobCacheEntry struct {
+	digest string
+	size   int64
+	repos  map[string]bool // the keys of the repositories linked to the blob
+}
+
+// BlobCacheRepoKey returns the key identifying an upstream repository in the
+// cache, given the base URL of the registry, the remote repository name and
+// the credential used for it; the same repository reached with different
+// credentials has different keys, as the credentials may grant different
+// access
+func BlobCacheRepoKey(registryURL, repository, credential string) string {
+	sum := sha256.Sum256([]byte(registryURL + "\x00" + repository + "\x00" + credential))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewBlobCache returns a BlobCache using the given directory, blobs already
+// in the directory are added to the cache
+func NewBlobCache(dir string, maxSize int64) (*BlobCache, error) {
+	bc := &BlobCache{
+		Dir:     dir,
+		MaxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	for _, subdir := range []string{bc.blobDir(), bc.tmpDir(), bc.linkDir()} {
+		if err := os.MkdirAll(subdir, 0o750); err != nil {
+			return nil, fmt.Errorf("NewBlobCache: unable to create cache directory; error: %w", err)
+		}
+	}
+
+	// partial downloads from previous runs can't be resumed
+	tmpFiles, err := os.ReadDir(bc.tmpDir())
+	if err != nil {
+		return nil, fmt.Errorf("NewBlobCache: unable to read cache directory; error: %w", err)
+	}
+	for _, tmpFile := range tmpFiles {
+		os.Remove(filepath.Join(bc.tmpDir(), tmpFile.Name())) //nolint
+	}
+
+	// add existing blobs, least recently used first
+	blobFiles, err := os.ReadDir(bc.blobDir())
+	if err != nil {
+		return nil, fmt.Errorf("NewBlobCache: unable to read cache directory; error: %w", err)
+	}
+	var infos []fs.FileInfo
+	for _, blobFile := range blobFiles {
+		info, err := blobFile.Info()
+		if err != nil || !info.Mode().IsRegular() || !cacheableDigestRegex.MatchString("sha256:"+info.Name()) {
+			continue
+		}
+		if info.Size() > maxSize {
+			// e.g. left over from a larger cache_max_size
+			os.Remove(filepath.Join(bc.blobDir(), info.Name())) //nolint
+			continue
+		}
+		infos = append(infos, info)
+	}
+	slices.SortFunc(infos, func(a, b fs.FileInfo) int {
+		return a.ModTime().Compare(b.ModTime())
+	})
+	for _, info := range infos {
+		bc.add("sha256:"+info.Name(), info.Size())
+	}
+
+	// restore the links of the blobs to their repositories, blobs without any
+	// link can't be served
+	repoDirs, err := os.ReadDir(bc.linkDir())
+	if err != nil {
+		return nil, fmt.Errorf("NewBlobCache: unable to read cache directory; error: %w", err)
+	}
+	for _, repoDir := range repoDirs {
+		links, err := os.ReadDir(filepath.Join(bc.linkDir(), repoDir.Name()))
+		if err != nil {
+			continue
+		}
+		for _, link := range links {
+			if element, found := bc.entries["sha256:"+link.Name()]; found {
+				element.Value.(*blobCacheEntry).repos[repoDir.Name()] = true
+			} else {
+				os.Remove(filepath.Join(bc.linkDir(), repoDir.Name(), link.Name())) //nolint
+			}
+		}
+	}
+	bc.evict()
+
+	registryLogger.Info("NewBlobCache: blob cache ready", "dir", dir, "blobs", bc.lru.Len(), "size", bc.size, "max_size", maxSize)
+	return bc, nil
+}
+
+func (bc *BlobCache) blobDir() string {
+	return filepath.Join(bc.Dir, "blobs", "sha256")
+}
+
+func (bc *BlobCache) tmpDir() string {
+	return filepath.Join(bc.Dir, "tmp")
+}
+
+func (bc *BlobCache) linkDir() string {
+	return filepath.Join(bc.Dir, "links")
+}
+
+// linkPath returns the location of the link between the repository with the
+// given key and the blob with the given (cacheable) digest
+func (bc *BlobCache) linkPath(repo, digest string) string {
+	return filepath.Join(bc.linkDir(), repo, digest[len("sha256:"):])
+}
+
+// path returns the location of the blob with the given (cacheable) digest
+func (bc *BlobCache) path(digest string) string {
+	return filepath.Join(bc.blobDir(), digest[len("sha256:"):])
+}
+
+// Cacheable returns true if blobs with the given digest can be cached
+func (bc *BlobCache) Cacheable(digest string) bool {
+	return cacheableDigestRegex.MatchString(digest)
+}
+
+// Open returns the cached blob with the given digest and its size, ok is
+// false if the blob isn't cached or wasn't fetched for the repository with
+// the given key
+func (bc *BlobCache) Open(repo, digest string) (f *os.File, size int64, ok bool) {
+	if !bc.Cacheable(digest) {
+		return nil, 0, false
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	element, found := bc.entries[digest]
+	if !found || !element.Value.(*blobCacheEntry).repos[repo] {
+		return nil, 0, false
+	}
+	f, err := os.Open(bc.path(digest))
+	if err != nil {
+		// the file went missing, forget about it
+		registryLogger.Warn("BlobCache.Open: unable to open cached blob", "digest", digest, "error", err)
+		bc.remove(element)
+		return nil, 0, false
+	}
+	bc.lru.MoveToFront(element)
+
+	// the modification time records the LRU order across restarts
+	now := time.Now()
+	os.Chtimes(bc.path(digest), now, now) //nolint
+
+	return f, element.Value.(*blobCacheEntry).size, true
+}
+
+// Tee returns a reader which passes through the given blob body while also
+// writing it into the cache; the blob is only added to the cache (and linked
+// to the repository with the given key) if the whole body was read and its
+// digest matched
+func (bc *BlobCache) Tee(repo, digest string, body io.ReadCloser) io.ReadCloser {
+	if !bc.Cacheable(digest) {
+		return body
+	}
+	tmp, err := os.CreateTemp(bc.tmpDir(), "blob-*")
+	if err != nil {
+		registryLogger.Warn("BlobCache.Tee: unable to create temporary file", "error", err)
+		return body
+	}
+	return &blobCacheWriter{
+		cache:  bc,
+		repo:   repo,
+		digest: digest,
+		body:   body,
+		tmp:    tmp,
+		hash:   sha256.New(),
+	}
+}
+
+// add inserts a blob at the front of the LRU list; the caller must hold bc.mu
+func (bc *BlobCache) add(digest string, size int64) {
+	if element, found := bc.entries[digest]; found {
+		bc.lru.MoveToFront(element)
+		return
+	}
+	bc.entries[digest] = bc.lru.PushFront(&blobCacheEntry{digest: digest, size: size, repos: map[string]bool{}})
+	bc.size += size
+}
+
+// remove drops a blob from the cache; the caller must hold bc.mu
+func (bc *BlobCache) remove(element *list.Element) {
+	entry := bc.lru.Remove(element).(*blobCacheEntry)
+	delete(bc.entries, entry.digest)
+	bc.size -= entry.size
+	if err := os.Remove(bc.path(entry.digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		registryLogger.Warn("BlobCache.remove: unable to remove cached blob", "digest", entry.digest, "error", err)
+	}
+	for repo := range entry.repos {
+		os.Remove(bc.linkPath(repo, entry.digest)) //nolint
+	}
+}
+
+// evict removes the least recently used blobs until the cache is within its
+// maximum size; the caller must hold bc.mu
+func (bc *BlobCache) evict() {
+	for bc.size > bc.MaxSize && bc.lru.Len() > 0 {
+		oldest := bc.lru.Back()
+		registryLogger.Debug("BlobCache.evict: evicting blob", "digest", oldest.Value.(*blobCacheEntry).digest)
+		bc.remove(oldest)
+	}
+}
+
+// commit moves a verified temporary file into the cache and links it to the
+// repository it was fetched for
+func (bc *BlobCache) commit(repo, digest string, tmpPath string, size int64) error {
+	// evicting everything else wouldn't make room for it
+	if size > bc.MaxSize {
+		return fmt.Errorf("blob of %d bytes is larger than the cache", size)
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(bc.linkDir(), repo), 0o750); err != nil {
+		return err
+	}
+	if err := os.WriteFile(bc.linkPath(repo, digest), nil, 0o640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, bc.path(digest)); err != nil {
+		os.Remove(bc.linkPath(repo, digest)) //nolint
+		return err
+	}
+	bc.add(digest, size)
+	bc.entries[digest].Value.(*blobCacheEntry).repos[repo] = true
+	bc.evict()
+	return nil
+}
+
+// blobCacheWriter is the io.ReadCloser returned by BlobCache.Tee
+type blobCacheWriter struct {
+	cache  *BlobCache
+	repo   string
+	digest string
+	body   io.ReadCloser
+	tmp    *os.File
+	hash   hash.Hash
+	size   int64
+	failed bool // set when writing to the cache failed, the body is still passed through
+	done   bool // set once the temporary file has been committed or discarded
+}
+
+// Read reads from the upstream body and copies the data into the cache
+func (w *blobCacheWriter) Read(p []byte) (int, error) {
+	n, err := w.body.Read(p)
+	if n > 0 && !w.failed && !w.done {
+		if _, werr := w.tmp.Write(p[:n]); werr != nil {
+			registryLogger.Warn("blobCacheWriter.Read: unable to write to cache", "digest", w.digest, "error", werr)
+			w.failed = true
+		}
+		w.hash.Write(p[:n]) //nolint
+		w.size += int64(n)
+	}
+	if errors.Is(err, io.EOF) {
+		w.finish(true)
+	}
+	return n, err
+}
+
+// Close closes the upstream body, discarding any incomplete cache entry
+func (w *blobCacheWriter) Close() error {
+	w.finish(false)
+	return w.body.Close()
+}
+
+// finish commits the temporary file if the body was read completely and the
+// digest matched, otherwise the temporary file is removed
+func (w *blobCacheWriter) finish(complete bool) {
+	if w.done {
+		return
+	}
+	w.done = true
+	tmpPath := w.tmp.Name()
+	w.tmp.Close() //nolint
+
+	if !complete || w.failed {
+		os.Remove(tmpPath) //nolint
+		return
+	}
+	actual := "sha256:" + hex.EncodeToString(w.hash.Sum(nil))
+	if actual != w.digest {
+		registryLogger.Warn("blobCacheWriter.finish: blob digest mismatch, not caching", "expected", w.digest, "actual", actual)
+		os.Remove(tmpPath) //nolint
+		return
+	}
+	if err := w.cache.commit(w.repo, w.digest, tmpPath, w.size); err != nil {
+		registryLogger.Warn("blobCacheWriter.finish: unable to commit blob to cache", "digest", w.digest, "error", err)
+		os.Remove(tmpPath) //nolint
+		return
+	}
+	registryLogger.Debug("blobCacheWriter.finish: cached blob", "digest", w.digest, "size", w.size)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testBlob(contents string) (string, []byte) {
+	sum := sha256.Sum256([]byte(contents))
+	return "sha256:" + hex.EncodeToString(sum[:]), []byte(contents)
+}
+
+func TestBlobCacheLinks(t *testing.T) {
+	dir := t.TempDir()
+	digest, blob := testBlob("layer")
+	repoA := BlobCacheRepoKey("https://ghcr.io", "org/a", "")
+	repoB := BlobCacheRepoKey("https://ghcr.io", "org/b", "")
+
+	bc, err := NewBlobCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := bc.Tee(repoA, digest, io.NopCloser(bytes.NewReader(blob)))
+	io.ReadAll(body) //nolint
+	body.Close()     //nolint
+
+	// the links must survive a restart
+	restarted, err := NewBlobCache(dir, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, cache := range map[string]*BlobCache{"running": bc, "restarted": restarted} {
+		f, size, ok := cache.Open(repoA, digest)
+		if !ok || size != int64(len(blob)) {
+			t.Errorf("%s: Open(repoA) = %d, %v; want the cached blob", name, size, ok)
+		} else {
+			f.Close() //nolint
+		}
+		if _, _, ok := cache.Open(repoB, digest); ok {
+			t.Errorf("%s: Open(repoB) served a blob which was only fetched for repoA", name)
+		}
+	}
+}
+
+func TestBlobCacheDigestMismatch(t *testing.T) {
+	bc, err := NewBlobCache(t.TempDir(), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, _ := testBlob("layer")
+	repo := BlobCacheRepoKey("https://ghcr.io", "org/a", "")
+	body := bc.Tee(repo, digest, io.NopCloser(bytes.NewReader([]byte("tampered"))))
+	io.ReadAll(body) //nolint
+	body.Close()     //nolint
+	if _, _, ok := bc.Open(repo, digest); ok {
+		t.Error("a blob which didn't match its digest was cached")
+	}
+}
+
+func TestRegistryProxyBlobCacheScope(t *testing.T) {
+	digest, blob := testBlob("private layer")
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// the blob only exists in the private repository
+		if r.URL.Path == "/v2/private/app/blobs/"+digest {
+			w.Write(blob) //nolint
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	front := newTestServer(t, "cache_dir: "+t.TempDir()+"\nproxies:\n"+
+		proxyYAML("private/", upstream, "private")+
+		proxyYAML("public/", upstream, "public"))
+
+	_, privateToken := getToken(t, front, "scope=repository:private/app:pull", "", "")
+	resp := doRequest(t, front, http.MethodGet, "/v2/private/app/blobs/"+digest, privateToken)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !bytes.Equal(body, blob) {
+		t.Fatalf("fetching the blob through the private proxy: status %d", resp.StatusCode)
+	}
+
+	// served from the cache for the repository it was fetched for
+	upstreamFetches := len(upstream.Requests("/v2/private/app/blobs/" + digest))
+	resp = doRequest(t, front, http.MethodGet, "/v2/private/app/blobs/"+digest, privateToken)
+	if resp.StatusCode != http.StatusOK || len(upstream.Requests("/v2/private/app/blobs/"+digest)) != upstreamFetches {
+		t.Errorf("second fetch: status %d, want 200 from the cache", resp.StatusCode)
+	}
+
+	// but a token for another repository must not get it out of the cache
+	_, publicToken := getToken(t, front, "scope=repository:public/other:pull", "", "")
+	resp = doRequest(t, front, http.MethodGet, "/v2/public/other/blobs/"+digest, publicToken)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("fetching the blob through another repository: status %d, want the upstream 404", resp.StatusCode)
+	}
+}
+
+// a CDN which doesn't answer a followed blob redirect in time is given up
+// on, and the client gets the redirect instead
+func TestRegistryProxyBlobRedirectTimeout(t *testing.T) {
+	previousTimeout := blobRedirectTransport.ResponseHeaderTimeout
+	blobRedirectTransport.ResponseHeaderTimeout = 100 * time.Millisecond
+	defer func() { blobRedirectTransport.ResponseHeaderTimeout = previousTimeout }()
+
+	digest, _ := testBlob("layer on a stalled CDN")
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(cdn.Close)
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, cdn.URL+"/blob", http.StatusTemporaryRedirect)
+	})
+	front := newTestServer(t, "cache_dir: "+t.TempDir()+"\nproxies:\n"+proxyYAML("a/", upstream, "org"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/v2/a/app/blobs/"+digest, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close() //nolint
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != cdn.URL+"/blob" {
+		t.Errorf("status %d, location %q; want the redirect to the CDN", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the request took %s", elapsed)
+	}
+}
+
+func TestRegistryProxyBlobCacheCredentials(t *testing.T) {
+	digest, blob := testBlob("layer only the credentials may read")
+	var served atomic.Bool
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		// only the first request, made with the private proxy's
+		// credentials, is allowed to read the blob
+		if served.CompareAndSwap(false, true) {
+			w.Write(blob) //nolint
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})
+	front := newTestServer(t, "cache_dir: "+t.TempDir()+"\nproxies:\n"+
+		proxyYAML("priv/", upstream, "org", `auth: "Basic cHJpdjpzZWNyZXQ="`)+
+		proxyYAML("pub/", upstream, "org"))
+	path := "/v2/org/app/blobs/" + digest
+
+	_, privateToken := getToken(t, front, "scope=repository:priv/app:pull", "", "")
+	resp := doRequest(t, front, http.MethodGet, "/v2/priv/app/blobs/"+digest, privateToken)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !bytes.Equal(body, blob) {
+		t.Fatalf("fetching the blob through the private proxy: status %d", resp.StatusCode)
+	}
+
+	// the same upstream repository through a proxy with other credentials
+	// must be asked upstream rather than served from the cache
+	_, publicToken := getToken(t, front, "scope=repository:pub/app:pull", "", "")
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		upstreamFetches := len(upstream.Requests(path))
+		resp = doRequest(t, front, method, "/v2/pub/app/blobs/"+digest, publicToken)
+		if resp.StatusCode != http.StatusNotFound || len(upstream.Requests(path)) != upstreamFetches+1 {
+			t.Errorf("%s through the public proxy: status %d, want the upstream 404", method, resp.StatusCode)
+		}
+	}
+
+	// the private proxy still gets it from the cache
+	resp = doRequest(t, front, http.MethodGet, "/v2/priv/app/blobs/"+digest, privateToken)
+	if body, _ := io.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !bytes.Equal(body, blob) {
+		t.Errorf("fetching the blob through the private proxy again: status %d", resp.StatusCode)
+	}
+}
+
+func TestBlobCacheOversizedBlob(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := NewBlobCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := BlobCacheRepoKey("https://ghcr.io", "org/a", "")
+	tee := func(digest string, blob []byte) {
+		body := bc.Tee(repo, digest, io.NopCloser(bytes.NewReader(blob)))
+		if read, _ := io.ReadAll(body); !bytes.Equal(read, blob) {
+			t.Errorf("the body of %s was changed", digest)
+		}
+		body.Close() //nolint
+	}
+	smallDigest, small := testBlob("small layer")
+	largeDigest, large := testBlob(strings.Repeat("large layer ", 20))
+	tee(smallDigest, small)
+	tee(largeDigest, large)
+
+	if _, _, ok := bc.Open(repo, largeDigest); ok {
+		t.Error("a blob larger than the cache was cached")
+	}
+	if f, _, ok := bc.Open(repo, smallDigest); !ok {
+		t.Error("caching a blob larger than the cache evicted the other blobs")
+	} else {
+		f.Close() //nolint
+	}
+
+	// blobs too large for the cache are dropped at startup too, without
+	// evicting the others
+	if err := os.WriteFile(filepath.Join(dir, "blobs", "sha256", largeDigest[len("sha256:"):]), large, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	restarted, err := NewBlobCache(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restarted.size != int64(len(small)) {
+		t.Errorf("restarted cache holds %d bytes, want %d", restarted.size, len(small))
+	}
+}
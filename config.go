@@ -1,28 +1,67 @@
 package main
 
 import (
+	"cmp"
 	"encoding/json"
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 type ProxyItem struct {
-	RegistryHost string `yaml:"registry" json:"registry"`
-	RemotePrefix string `yaml:"remote" json:"remote"`
-	LocalPrefix  string `yaml:"-" json:"-"` // this is set from the item name
-	AuthHeader   string `yaml:"auth" json:"auth"`
+	RegistryHost string      `yaml:"registry" json:"registry"` // host[:port], or a URL like "http://registry.local:5000" which also sets the scheme
+	Scheme       string      `yaml:"scheme" json:"scheme"`     // "https" (the default) or "http" for plain-HTTP registries
+	RemotePrefix string      `yaml:"remote" json:"remote"`
+	LocalPrefix  string      `yaml:"-" json:"-"` // this is set from the item name
+	AuthHeader   string      `yaml:"auth" json:"auth"`
+	Actions      []string    `yaml:"actions" json:"actions"`             // scope actions clients may be granted; defaults to pull only
+	Priority     int         `yaml:"priority" json:"priority"`           // higher priority proxies are matched first
+	Users        []string    `yaml:"users" json:"users"`                 // htpasswd users allowed to get tokens; anyone if empty
+	Groups       []string    `yaml:"groups" json:"groups"`               // groups allowed to get tokens; anyone if empty
+	Claims       []ClaimRule `yaml:"claims" json:"claims"`               // OIDC claim rules, a token matching any rule may get tokens
+	ManifestTTL  string      `yaml:"manifest_ttl" json:"manifest_ttl"`   // how long manifests fetched by tag are served without revalidation
+	TokenRealm   string      `yaml:"token_realm" json:"token_realm"`     // URL of the upstream token service; discovered from the registry if empty
+	TokenService string      `yaml:"token_service" json:"token_service"` // service name for the upstream token service; defaults to the registry host
+
+	manifestTTL time.Duration // parsed from ManifestTTL
 }
 
+// validActions are the scope actions that may be listed in ProxyItem.Actions
+var validActions = []string{"pull", "push", "delete"}
+
 type Config struct {
-	ListenAddr string               `yaml:"listen_addr" json:"listen_addr"`
-	ListenPort string               `yaml:"listen_port" json:"listen_port"`
-	ProxyFQDN  string               `yaml:"proxy_fqdn" json:"proxy_fqdn"`
-	SecretKey  string               `yaml:"secret_key" json:"secret_key"`
-	LogLevel   string               `yaml:"log_level" json:"log_level"`
-	Proxies    map[string]ProxyItem `yaml:"proxies" json:"proxies"`
+	ListenAddr           string               `yaml:"listen_addr" json:"listen_addr"`
+	ListenPort           string               `yaml:"listen_port" json:"listen_port"`
+	ProxyFQDN            string               `yaml:"proxy_fqdn" json:"proxy_fqdn"`
+	SecretKey            string               `yaml:"secret_key" json:"secret_key"`
+	LogLevel             string               `yaml:"log_level" json:"log_level"`
+	LogLevels            map[string]string    `yaml:"log_levels" json:"log_levels"`                         // levels of the token, registry and discovery components; they follow log_level if unset
+	LogFormat            string               `yaml:"log_format" json:"log_format"`                         // "text" (the default) or "json"
+	DebugBodyLimit       string               `yaml:"debug_body_limit" json:"debug_body_limit"`             // most bytes of a JSON body logged at DEBUG level, e.g. "64KiB"; "0" disables body logging
+	HtpasswdFile         string               `yaml:"htpasswd" json:"htpasswd"`                             // bcrypt htpasswd file with the users who may log in
+	Groups               map[string][]string  `yaml:"groups" json:"groups"`                                 // mapping of group names to htpasswd users
+	OIDC                 []OIDCProvider       `yaml:"oidc" json:"oidc"`                                     // OIDC providers whose ID tokens clients may log in with
+	CacheDir             string               `yaml:"cache_dir" json:"cache_dir"`                           // directory for cached blobs; caching is disabled if empty
+	CacheMaxSize         string               `yaml:"cache_max_size" json:"cache_max_size"`                 // e.g. "10GiB"
+	ManifestCacheEntries int                  `yaml:"manifest_cache_entries" json:"manifest_cache_entries"` // manifests kept in memory; caching is disabled if 0
+	ShutdownDelay        string               `yaml:"shutdown_delay" json:"shutdown_delay"`                 // how long to report unready before closing the listener
+	ShutdownTimeout      string               `yaml:"shutdown_timeout" json:"shutdown_timeout"`             // how long to wait for in-flight requests on shutdown
+	MetricsAddr          string               `yaml:"metrics_addr" json:"metrics_addr"`                     // listen address for the prometheus /metrics endpoint, e.g. ":9090"
+	AccessLog            AccessLogConfig      `yaml:"access_log" json:"access_log"`                         // per-request access log; disabled if no file is set
+	Tracing              TracingConfig        `yaml:"tracing" json:"tracing"`                               // OpenTelemetry trace export; disabled if no endpoint is set
+	WatchConfig          bool                 `yaml:"watch_config" json:"watch_config"`                     // reload the config when the file changes
+	Admin                AdminConfig          `yaml:"admin" json:"admin"`                                   // who may use the admin endpoints; they're disabled if nobody may
+	Proxies              map[string]ProxyItem `yaml:"proxies" json:"proxies"`
+
+	path           string      // the file the config was loaded from
+	routes         []ProxyItem // the proxies in the order they are matched, see Config.Match
+	debugBodyLimit int64       // parsed from DebugBodyLimit
 }
 
 func LoadConfig(configPath string) (Config, error) {
@@ -41,9 +80,17 @@ func LoadConfig(configPath string) (Config, error) {
 	if err != nil {
 		return config, err
 	}
+	config.path = configPath
 
-	if config.LogLevel != "" {
-		setLogLevel(config.LogLevel)
+	switch config.LogFormat {
+	case "":
+		config.LogFormat = logFormatText
+	case logFormatText, logFormatJSON:
+	default:
+		return config, fmt.Errorf("log_format: unknown format \"%s\", must be one of: %s, %s", config.LogFormat, logFormatText, logFormatJSON)
+	}
+	if err := (LogLevels{Level: config.LogLevel, Components: config.LogLevels}).Validate(); err != nil {
+		return config, fmt.Errorf("log_level: %w", err)
 	}
 	if config.ListenAddr == "" {
 		config.ListenAddr = GetEnvDefault("LISTEN_ADDR", "0.0.0.0")
@@ -52,19 +99,172 @@ func LoadConfig(configPath string) (Config, error) {
 		config.ListenPort = GetEnvDefault("LISTEN_PORT", "5000")
 	}
 
+	for i, provider := range config.OIDC {
+		if provider.Issuer == "" || provider.Audience == "" {
+			return config, fmt.Errorf("oidc provider %d: issuer and audience are required", i)
+		}
+		if (provider.JWKSFile == "") == (provider.JWKSURL == "") {
+			return config, fmt.Errorf("oidc provider %s: exactly one of jwks_file or jwks_url must be set", provider.Issuer)
+		}
+	}
+
+	if config.ShutdownDelay == "" {
+		config.ShutdownDelay = "0s"
+	}
+	if config.ShutdownTimeout == "" {
+		config.ShutdownTimeout = "30s"
+	}
+	for name, value := range map[string]string{"shutdown_delay": config.ShutdownDelay, "shutdown_timeout": config.ShutdownTimeout} {
+		if _, err := time.ParseDuration(value); err != nil {
+			return config, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	switch config.AccessLog.Format {
+	case "":
+		config.AccessLog.Format = accessLogFormatJSON
+	case accessLogFormatJSON, accessLogFormatCombined:
+	default:
+		return config, fmt.Errorf("access_log: unknown format \"%s\", must be one of: %s, %s", config.AccessLog.Format, accessLogFormatJSON, accessLogFormatCombined)
+	}
+	if config.Tracing.SampleRatio == 0 {
+		config.Tracing.SampleRatio = 1
+	}
+	if config.DebugBodyLimit == "" {
+		config.DebugBodyLimit = defaultDebugBodyLimit
+	}
+	config.debugBodyLimit, err = ParseSize(config.DebugBodyLimit)
+	if err != nil {
+		return config, fmt.Errorf("debug_body_limit: %w", err)
+	}
+	if config.CacheMaxSize == "" {
+		config.CacheMaxSize = defaultCacheMaxSize
+	}
+	if _, err := ParseSize(config.CacheMaxSize); err != nil {
+		return config, fmt.Errorf("cache_max_size: %w", err)
+	}
+
+	// claim rules only apply to tokens of a single issuer, which may be left
+	// out if only one oidc provider is configured
+	if len(config.OIDC) == 1 {
+		config.Admin.Claims = WithDefaultIssuer(config.Admin.Claims, config.OIDC[0].Issuer)
+	}
+
 	// set LocalPrefix from ProxyItem names
 	for proxyName, proxyItem := range config.Proxies {
 		proxyItem.LocalPrefix = proxyName
+		if len(config.OIDC) == 1 {
+			proxyItem.Claims = WithDefaultIssuer(proxyItem.Claims, config.OIDC[0].Issuer)
+		}
+		if err := proxyItem.parseRegistry(); err != nil {
+			return config, fmt.Errorf("proxy %s: %w", proxyName, err)
+		}
+		if proxyItem.TokenRealm != "" {
+			realm, err := url.Parse(proxyItem.TokenRealm)
+			if err != nil || !realm.IsAbs() || realm.Host == "" || (realm.Scheme != "https" && realm.Scheme != "http") {
+				return config, fmt.Errorf("proxy %s: token_realm must be an absolute http or https URL", proxyName)
+			}
+			if proxyItem.TokenService == "" {
+				proxyItem.TokenService = proxyItem.RegistryHost
+			}
+		} else if proxyItem.TokenService != "" {
+			return config, fmt.Errorf("proxy %s: token_service is set but token_realm isn't", proxyName)
+		}
+		if len(proxyItem.Actions) == 0 {
+			proxyItem.Actions = []string{"pull"}
+		}
+		for _, action := range proxyItem.Actions {
+			if !slices.Contains(validActions, action) {
+				return config, fmt.Errorf("proxy %s: unknown action \"%s\", must be one of: %s", proxyName, action, strings.Join(validActions, ", "))
+			}
+		}
+		if err := config.checkAccess(proxyItem.Users, proxyItem.Groups, proxyItem.Claims); err != nil {
+			return config, fmt.Errorf("proxy %s: %w", proxyName, err)
+		}
+		if proxyItem.ManifestTTL != "" {
+			ttl, err := time.ParseDuration(proxyItem.ManifestTTL)
+			if err != nil {
+				return config, fmt.Errorf("proxy %s: invalid manifest_ttl; error: %w", proxyName, err)
+			}
+			proxyItem.manifestTTL = ttl
+		}
 		config.Proxies[proxyName] = proxyItem
 	}
+	config.buildRoutes()
+	if err := config.checkAccess(config.Admin.Users, config.Admin.Groups, config.Admin.Claims); err != nil {
+		return config, fmt.Errorf("admin: %w", err)
+	}
 
 	return config, nil
 }
 
+// ApplyLogSettings puts the logging settings which may change on reload into
+// effect; LoadConfig only validates them, so a configuration which fails to
+// load leaves the running settings alone
+func (cfg Config) ApplyLogSettings() {
+	debugBodyLimit.Store(cfg.debugBodyLimit)
+
+	// the configured levels replace any set through the admin endpoint;
+	// without log_level the level given on the command line applies again
+	logLevels := LogLevels{Level: cmp.Or(cfg.LogLevel, startupLogLevel), Components: map[string]string{}}
+	for name := range componentLevels {
+		logLevels.Components[name] = cfg.LogLevels[name]
+	}
+	logLevels.Apply() //nolint
+}
+
+// WithDefaultIssuer returns the claim rules with iss set to the given issuer
+// in those which leave it out; empty rules are kept so checkAccess can
+// refuse them
+func WithDefaultIssuer(claims []ClaimRule, issuer string) []ClaimRule {
+	if len(claims) == 0 {
+		return claims
+	}
+	result := make([]ClaimRule, 0, len(claims))
+	for _, rule := range claims {
+		if _, ok := rule["iss"]; ok || len(rule) == 0 {
+			result = append(result, rule)
+			continue
+		}
+		withIssuer := maps.Clone(rule)
+		withIssuer["iss"] = issuer
+		result = append(result, withIssuer)
+	}
+	return result
+}
+
+// checkAccess checks that the htpasswd file and OIDC providers needed by the
+// given access rules are configured
+func (cfg Config) checkAccess(users, groups []string, claims []ClaimRule) error {
+	if (len(users) > 0 || len(groups) > 0) && cfg.HtpasswdFile == "" {
+		return fmt.Errorf("users or groups are set but no htpasswd file is configured")
+	}
+	for _, group := range groups {
+		if _, ok := cfg.Groups[group]; !ok {
+			return fmt.Errorf("unknown group \"%s\"", group)
+		}
+	}
+	if len(claims) > 0 && len(cfg.OIDC) == 0 {
+		return fmt.Errorf("claims are set but no oidc providers are configured")
+	}
+	for i, rule := range claims {
+		if len(rule) == 0 {
+			return fmt.Errorf("claims rule %d is empty", i)
+		}
+		// LoadConfig has set the issuer if only one provider is configured
+		if _, ok := rule["iss"]; !ok {
+			return fmt.Errorf("claims rule %d must set iss when several oidc providers are configured", i)
+		}
+		if !slices.ContainsFunc(cfg.OIDC, func(provider OIDCProvider) bool { return provider.Issuer == rule["iss"] }) {
+			return fmt.Errorf("claims rule %d: iss \"%s\" is not the issuer of a configured oidc provider", i, rule["iss"])
+		}
+	}
+	return nil
+}
+
 // Log writes a pretty-printed version of the configuration
 func (cfg Config) Log() {
-	// log the fully-parsed config data
-	configJSON, err := json.MarshalIndent(cfg, "", "  ")
+	// log the fully-parsed config data, without any secrets
+	configJSON, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
 	if err != nil {
 		logger.Error("problem printing config", "error", err)
 		return
@@ -73,26 +273,126 @@ func (cfg Config) Log() {
 	fmt.Println(string(configJSON))
 }
 
+// buildRoutes sorts the configured proxies into the order in which they are
+// matched: by descending Priority, then by descending LocalPrefix length (so
+// the longest prefix wins), then alphabetically so the order is deterministic
+func (cfg *Config) buildRoutes() {
+	cfg.routes = make([]ProxyItem, 0, len(cfg.Proxies))
+	for _, proxy := range cfg.Proxies {
+		cfg.routes = append(cfg.routes, proxy)
+	}
+	slices.SortFunc(cfg.routes, func(a, b ProxyItem) int {
+		if a.Priority != b.Priority {
+			return cmp.Compare(b.Priority, a.Priority)
+		}
+		if len(a.LocalPrefix) != len(b.LocalPrefix) {
+			return cmp.Compare(len(b.LocalPrefix), len(a.LocalPrefix))
+		}
+		return cmp.Compare(a.LocalPrefix, b.LocalPrefix)
+	})
+}
+
 // BestMatch searches through the configured proxies and tries to find the best
 // match for the given auth token resource scope based on the LocalPrefix values
 func (cfg Config) BestMatch(scope *ResourceScope) (ProxyItem, error) {
-	if exactMatch, ok := cfg.Proxies[scope.ResourceName]; ok {
-		return exactMatch, nil
-	}
+	return cfg.Match(scope.ResourceName)
+}
 
-	// we allow partial matches if the LocalPrefix ends in a slash
-	var matches []ProxyItem
-	for _, proxy := range cfg.Proxies {
-		if strings.HasSuffix(proxy.LocalPrefix, "/") && strings.HasPrefix(scope.ResourceName, proxy.LocalPrefix) {
-			matches = append(matches, proxy)
+// Match returns the proxy which handles the given (local) repository name;
+// see buildRoutes for the order in which proxies are considered
+func (cfg Config) Match(name string) (ProxyItem, error) {
+	for _, proxy := range cfg.routes {
+		if proxy.Matches(name) {
+			return proxy, nil
 		}
 	}
+	return ProxyItem{}, fmt.Errorf("no matching proxy configuration was found")
+}
 
-	if len(matches) == 0 {
-		return ProxyItem{}, fmt.Errorf("no matching proxy configuration was found")
+// Matches returns true if the given repository name is handled by the proxy;
+// names must equal the LocalPrefix, unless the LocalPrefix ends in a slash in
+// which case any name starting with the LocalPrefix matches
+func (p ProxyItem) Matches(name string) bool {
+	if name == p.LocalPrefix {
+		return true
 	}
+	return strings.HasSuffix(p.LocalPrefix, "/") && strings.HasPrefix(name, p.LocalPrefix)
+}
 
-	return matches[0], nil
+// parseRegistry splits a registry given as a URL into RegistryHost and
+// Scheme, and checks the scheme
+func (p *ProxyItem) parseRegistry() error {
+	if strings.Contains(p.RegistryHost, "://") {
+		u, err := url.Parse(p.RegistryHost)
+		if err != nil || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" || u.User != nil {
+			return fmt.Errorf("registry must be a host name or a URL without a path, e.g. http://registry.local:5000")
+		}
+		if p.Scheme != "" && p.Scheme != u.Scheme {
+			return fmt.Errorf("the scheme of the registry URL conflicts with scheme \"%s\"", p.Scheme)
+		}
+		p.RegistryHost = u.Host
+		p.Scheme = u.Scheme
+	}
+	if p.RegistryHost == "" {
+		return fmt.Errorf("registry is required")
+	}
+	if p.Scheme == "" {
+		p.Scheme = "https"
+	}
+	if p.Scheme != "https" && p.Scheme != "http" {
+		return fmt.Errorf("unknown scheme \"%s\", must be https or http", p.Scheme)
+	}
+	return nil
+}
+
+// RegistryURL returns the base URL of the upstream registry, e.g.
+// "https://ghcr.io" or "http://registry.local:5000"
+func (p ProxyItem) RegistryURL() string {
+	return p.Scheme + "://" + p.RegistryHost
+}
+
+// SharesUpstream returns true if the two proxies get their tokens from the
+// same upstream registry with the same credentials, so the scopes of both
+// can be requested in one upstream token request
+func (p ProxyItem) SharesUpstream(other ProxyItem) bool {
+	return p.RegistryURL() == other.RegistryURL() && p.AuthHeader == other.AuthHeader &&
+		p.TokenRealm == other.TokenRealm && p.TokenService == other.TokenService
+}
+
+// AdminConfig lists the clients which may use the admin endpoints, in the
+// same way as a ProxyItem's users, groups and claims
+type AdminConfig struct {
+	Users  []string    `yaml:"users" json:"users"`
+	Groups []string    `yaml:"groups" json:"groups"`
+	Claims []ClaimRule `yaml:"claims" json:"claims"`
+}
+
+// Enabled returns true if anybody may use the admin endpoints
+func (a AdminConfig) Enabled() bool {
+	return len(a.Users) > 0 || len(a.Groups) > 0 || len(a.Claims) > 0
+}
+
+// Allows returns true if clients may be granted the given scope action
+func (p ProxyItem) Allows(action string) bool {
+	return slices.Contains(p.Actions, action)
+}
+
+// RequiresAuth returns true if clients must authenticate to get tokens for
+// the proxy
+func (p ProxyItem) RequiresAuth() bool {
+	return len(p.Users) > 0 || len(p.Groups) > 0 || len(p.Claims) > 0
+}
+
+// FilterActions returns the subset of the given scope actions which the
+// proxy allows
+func (p ProxyItem) FilterActions(actions []string) []string {
+	result := []string{}
+	for _, action := range actions {
+		if p.Allows(action) {
+			result = append(result, action)
+		}
+	}
+	return result
 }
 
 // GetEnvDefault retrieves the value of the environment variable named by key.
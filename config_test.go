@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// loadTestConfig loads the given configuration, to which the secret key is
+// added
+func loadTestConfig(t *testing.T, configYAML string) (Config, error) {
+	t.Helper()
+	return LoadConfig(writeTestFile(t, "config.yaml", "secret_key: "+testSecretKey+"\n"+configYAML))
+}
+
+func TestConfigMatch(t *testing.T) {
+	config, err := loadTestConfig(t, `
+proxies:
+  "bp/":
+    registry: index.docker.io
+    remote: backplane
+  "bp/internal/":
+    registry: ghcr.io
+    remote: internal
+  "bp/internal/app":
+    registry: ghcr.io
+    remote: app
+  "pinned/":
+    registry: ghcr.io
+  "pinned/long/name/":
+    registry: ghcr.io
+  "a/":
+    registry: ghcr.io
+    priority: 10
+  "a/b/":
+    registry: ghcr.io
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		proxy string // empty if no proxy may match
+	}{
+		{"bp/true", "bp/"},
+		{"bp/internal/tool", "bp/internal/"},
+		{"bp/internal/app", "bp/internal/app"},      // exact names beat prefixes
+		{"bp/internal/app/sub", "bp/internal/"},     // exact names only match themselves
+		{"pinned/long/name/x", "pinned/long/name/"}, // longest prefix wins
+		{"a/b/c", "a/"},                             // unless another has a higher priority
+		{"bp", ""},                                  // the prefix itself isn't a repository
+		{"other/app", ""},
+		{"bpx/app", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy, err := config.Match(tt.name)
+			if tt.proxy == "" {
+				if err == nil {
+					t.Errorf("matched %s, want no match", proxy.LocalPrefix)
+				}
+				return
+			}
+			if err != nil || proxy.LocalPrefix != tt.proxy {
+				t.Errorf("matched %q (error %v), want %s", proxy.LocalPrefix, err, tt.proxy)
+			}
+			// the token endpoint must agree with the router
+			scoped, err := config.BestMatch(&ResourceScope{ResourceType: "repository", ResourceName: tt.name, ResourceActions: []string{"pull"}})
+			if err != nil || scoped.LocalPrefix != proxy.LocalPrefix {
+				t.Errorf("BestMatch matched %q, Match matched %s", scoped.LocalPrefix, proxy.LocalPrefix)
+			}
+		})
+	}
+}
+
+func TestConfigMatchIsDeterministic(t *testing.T) {
+	// equally long prefixes of equal priority are ordered by name, whatever
+	// the map iteration order
+	for i := 0; i < 20; i++ {
+		config, err := loadTestConfig(t, `
+proxies:
+  "x/":
+    registry: ghcr.io
+  "y/":
+    registry: ghcr.io
+  "x/a/":
+    registry: ghcr.io
+  "y/a/":
+    registry: ghcr.io
+`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		order := []string{}
+		for _, proxy := range config.routes {
+			order = append(order, proxy.LocalPrefix)
+		}
+		if got := order[0] + order[1] + order[2] + order[3]; got != "x/a/y/a/x/y/" {
+			t.Fatalf("route order %v", order)
+		}
+	}
+}
+
+func TestConfigTokenRealm(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxy   string
+		service string // the resulting token_service, if the config is valid
+		err     string // part of the error, if it isn't
+	}{
+		{"realm and service", "token_realm: https://auth.example.com/token\n    token_service: example", "example", ""},
+		{"realm without a service", "token_realm: https://auth.example.com/token", "registry.example.com:5000", ""},
+		{"plain-HTTP realm", "token_realm: http://auth.local/token", "registry.example.com:5000", ""},
+		{"relative realm", "token_realm: /token", "", "token_realm must be an absolute http or https URL"},
+		{"realm without a host", "token_realm: https:///token", "", "token_realm must be an absolute http or https URL"},
+		{"realm with another scheme", "token_realm: ftp://auth.example.com/token", "", "token_realm must be an absolute http or https URL"},
+		{"unparsable realm", "token_realm: \"https://auth example.com/%zz\"", "", "token_realm must be an absolute http or https URL"},
+		{"service without a realm", "token_service: example", "", "token_service is set but token_realm isn't"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, "proxies:\n  \"a/\":\n    registry: registry.example.com:5000\n    "+tt.proxy+"\n")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("LoadConfig error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if service := config.Proxies["a/"].TokenService; service != tt.service {
+				t.Errorf("token_service %q, want %q", service, tt.service)
+			}
+		})
+	}
+}
+
+func TestWithDefaultIssuer(t *testing.T) {
+	claims := []ClaimRule{{"repository": "org/app"}, {"iss": "https://other.example.com"}, {}}
+	defaulted := WithDefaultIssuer(claims, "https://issuer.example.com")
+	if defaulted[0]["iss"] != "https://issuer.example.com" || defaulted[1]["iss"] != "https://other.example.com" || len(defaulted[2]) != 0 {
+		t.Errorf("WithDefaultIssuer() = %v", defaulted)
+	}
+	if _, ok := claims[0]["iss"]; ok {
+		t.Error("WithDefaultIssuer() changed the given rules")
+	}
+
+	// validation doesn't fill in the issuer
+	config := Config{OIDC: []OIDCProvider{{Issuer: "https://issuer.example.com"}}}
+	if err := config.checkAccess(nil, nil, claims[:1]); err == nil {
+		t.Error("checkAccess() accepted a rule without iss")
+	}
+	if _, ok := claims[0]["iss"]; ok {
+		t.Error("checkAccess() changed the given rules")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+)
+
+// defaultDebugBodyLimit is used when debug_body_limit isn't set
+const defaultDebugBodyLimit = "64KiB"
+
+// debugBodyLimit is the most bytes of a body LogRequest and LogResponse
+// capture; set from the configuration by Config.ApplyLogSettings
+var debugBodyLimit atomic.Int64
+
+func init() {
+	limit, _ := ParseSize(defaultDebugBodyLimit)
+	debugBodyLimit.Store(limit)
+}
+
+// LogRequest logs the headers of an http.Request object and, for JSON
+// bodies, the start of the body; credentials and tokens are redacted. Nothing
+// is done unless debug logging is enabled for the given logger.
+func LogRequest(log *slog.Logger, preamble string, req *http.Request) {
+	if !log.Enabled(req.Context(), slog.LevelDebug) {
+		return
+	}
+	header := req.Header
+	req.Header = RedactHeaders(header)
+	dump, err := httputil.DumpRequest(req, false)
+	req.Header = header
+	if err != nil {
+		log.Debug("logRequest: failed httputil.DumpRequest", "error", err)
+		return
+	}
+	var body []byte
+	var truncated bool
+	body, truncated, req.Body = captureBody(log, req.Body, req.Header.Get("Content-Type"))
+	log.Debug(preamble, "request", string(dump), "body", string(RedactBody(body)), "body_truncated", truncated)
+}
+
+// LogResponse logs the headers of an http.Response object and, for JSON
+// bodies such as manifests and token responses, the start of the body;
+// credentials and tokens are redacted. Nothing is done unless debug logging
+// is enabled for the given logger.
+func LogResponse(log *slog.Logger, preamble string, resp *http.Response) {
+	if resp == nil {
+		return
+	}
+	ctx := context.Background()
+	if resp.Request != nil {
+		ctx = resp.Request.Context()
+	}
+	if !log.Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	header := resp.Header
+	resp.Header = RedactHeaders(header)
+	dump, err := httputil.DumpResponse(resp, false)
+	resp.Header = header
+	if err != nil {
+		log.Debug("logResponse: failed httputil.DumpResponse", "error", err)
+		return
+	}
+	var body []byte
+	var truncated bool
+	body, truncated, resp.Body = captureBody(log, resp.Body, resp.Header.Get("Content-Type"))
+	log.Debug(preamble, "response", string(dump), "body", string(RedactBody(body)), "body_truncated", truncated)
+}
+
+// debugCapturable returns true if bodies of the given content type are
+// small structured documents worth logging: JSON, including the manifest
+// and index media types, and signed schema 1 manifests. Blobs are never
+// captured.
+func debugCapturable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+prettyjws")
+}
+
+// captureBody reads up to debugBodyLimit bytes of a capturable body and
+// returns them with a replacement body which still yields the complete
+// content; other bodies are returned untouched without reading from them
+func captureBody(log *slog.Logger, body io.ReadCloser, contentType string) (captured []byte, truncated bool, replacement io.ReadCloser) {
+	limit := debugBodyLimit.Load()
+	if body == nil || body == http.NoBody || limit <= 0 || !debugCapturable(contentType) {
+		return nil, false, body
+	}
+	captured, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		log.Debug("captureBody: failed to read body", "error", err)
+	}
+	replacement = ReplayBody(captured, body)
+	if int64(len(captured)) > limit {
+		return captured[:limit], true, replacement
+	}
+	return captured, false, replacement
+}
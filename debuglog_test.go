@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// syncBuffer is a bytes.Buffer which may be written to by the handlers of a
+// test server while the test reads it
+type syncBuffer struct {
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buffer.Write(p)
+}
+
+// Entries decodes the JSON log lines written so far
+func (b *syncBuffer) Entries(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := []map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(b.buffer.Bytes()))
+	for decoder.More() {
+		entry := map[string]any{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// newTestLogger returns a logger writing JSON lines to the returned buffer
+func newTestLogger(level slog.Level) (*slog.Logger, *syncBuffer) {
+	buffer := &syncBuffer{}
+	return slog.New(slog.NewJSONHandler(buffer, &slog.HandlerOptions{Level: level})), buffer
+}
+
+// setDebugBodyLimit sets debug_body_limit for the duration of the test
+func setDebugBodyLimit(t *testing.T, limit int64) {
+	previous := debugBodyLimit.Load()
+	t.Cleanup(func() { debugBodyLimit.Store(previous) })
+	debugBodyLimit.Store(limit)
+}
+
+// countingBody is a response body which counts how often it's read
+type countingBody struct {
+	io.Reader
+	reads int
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	b.reads++
+	return b.Reader.Read(p)
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func TestLogResponse(t *testing.T) {
+	manifest := `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json","layers":[]}`
+	tests := []struct {
+		name          string
+		contentType   string
+		body          string
+		limit         int64
+		wantBody      string
+		wantTruncated bool
+	}{
+		{"json", "application/json", `{"repositories":[]}`, 1024, `{"repositories":[]}`, false},
+		{"json with parameters", "application/json; charset=utf-8", `{"tags":[]}`, 1024, `{"tags":[]}`, false},
+		{"manifest", testManifestType, manifest, 1024, manifest, false},
+		{"signed schema 1 manifest", "application/vnd.docker.distribution.manifest.v1+prettyjws", manifest, 1024, manifest, false},
+		{"token", "application/json", `{"token":"upstream-secret","expires_in":300}`, 1024,
+			`{"token":"` + Fingerprint("upstream-secret") + `","expires_in":300}`, false},
+		{"truncated", testManifestType, manifest, 16, manifest[:16], true},
+		{"exactly the limit", testManifestType, manifest, int64(len(manifest)), manifest, false},
+		{"body logging disabled", testManifestType, manifest, 0, "", false},
+		{"blob", "application/octet-stream", manifest, 1024, "", false},
+		{"text", "text/plain", "not json", 1024, "", false},
+		{"no content type", "", manifest, 1024, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setDebugBodyLimit(t, tt.limit)
+			log, buffer := newTestLogger(slog.LevelDebug)
+			body := &countingBody{Reader: strings.NewReader(tt.body)}
+			resp := &http.Response{StatusCode: http.StatusOK, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}, Body: body}
+			resp.Header.Set("Content-Type", tt.contentType)
+			resp.Header.Set("Www-Authenticate", `Bearer realm="https://auth.example.com/token"`)
+			LogResponse(log, "test response", resp)
+
+			if tt.wantBody == "" && (resp.Body != body || body.reads != 0) {
+				t.Error("a body which isn't logged was read or replaced")
+			}
+			if received, _ := io.ReadAll(resp.Body); string(received) != tt.body {
+				t.Errorf("client received %q, want %q", received, tt.body)
+			}
+
+			entries := buffer.Entries(t)
+			if len(entries) != 1 {
+				t.Fatalf("logged %d lines, want 1", len(entries))
+			}
+			entry := entries[0]
+			if entry["msg"] != "test response" || !strings.Contains(entry["response"].(string), "HTTP/1.1 200 OK") ||
+				!strings.Contains(entry["response"].(string), "Www-Authenticate: Bearer") {
+				t.Errorf("logged %v", entry)
+			}
+			if entry["body"] != tt.wantBody || entry["body_truncated"] != tt.wantTruncated {
+				t.Errorf("logged body %q (truncated %v), want %q (truncated %v)", entry["body"], entry["body_truncated"], tt.wantBody, tt.wantTruncated)
+			}
+		})
+	}
+}
+
+func TestLogRequest(t *testing.T) {
+	setDebugBodyLimit(t, 1024)
+	log, buffer := newTestLogger(slog.LevelDebug)
+	body := `{"grant_type":"refresh_token","refresh_token":"refresh-secret"}`
+	req, _ := http.NewRequest(http.MethodPost, "https://auth.example.com/token", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth("user", "password")
+	LogRequest(log, "test request", req)
+
+	if received, _ := io.ReadAll(req.Body); string(received) != body {
+		t.Errorf("upstream received %q, want %q", received, body)
+	}
+	if req.Header.Get("Authorization") == "" || strings.Contains(req.Header.Get("Authorization"), "REDACTED") {
+		t.Error("the request's credentials were changed")
+	}
+	entries := buffer.Entries(t)
+	if len(entries) != 1 {
+		t.Fatalf("logged %d lines, want 1", len(entries))
+	}
+	dump := entries[0]["request"].(string)
+	if !strings.HasPrefix(dump, "POST /token HTTP/1.1") || strings.Contains(dump, "dXNlcjpwYXNzd29yZA==") {
+		t.Errorf("logged request %q", dump)
+	}
+	if want := `{"grant_type":"refresh_token","refresh_token":"` + Fingerprint("refresh-secret") + `"}`; entries[0]["body"] != want {
+		t.Errorf("logged body %q, want %q", entries[0]["body"], want)
+	}
+}
+
+// nothing is logged or read below DEBUG level
+func TestLogResponseNotDebug(t *testing.T) {
+	log, buffer := newTestLogger(slog.LevelInfo)
+	body := &countingBody{Reader: strings.NewReader(`{"tags":[]}`)}
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}}, Body: body}
+	LogResponse(log, "test response", resp)
+	if resp.Body != body || body.reads != 0 {
+		t.Error("the body was read or replaced")
+	}
+	if entries := buffer.Entries(t); len(entries) != 0 {
+		t.Errorf("logged %v", entries)
+	}
+}
+
+// manifests fetched through the proxy are logged truncated, and reach the
+// client complete
+func TestDebugLogUpstreamResponse(t *testing.T) {
+	setDebugBodyLimit(t, 16)
+	log, buffer := newTestLogger(slog.LevelDebug)
+	previous := registryLogger
+	t.Cleanup(func() { registryLogger = previous })
+	registryLogger = log
+
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2,"mediaType":"application/vnd.oci.image.manifest.v1+json"}`)
+	front := newTestServer(t, "proxies:\n"+proxyYAML("a/", upstream.testUpstream, "org"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+
+	for _, entry := range buffer.Entries(t) {
+		if entry["msg"] == "RegistryProxy.Upstream: response from upstream" && strings.Contains(entry["response"].(string), "200 OK") {
+			if entry["body"] != string(upstream.manifest[:16]) || entry["body_truncated"] != true {
+				t.Errorf("logged body %q (truncated %v)", entry["body"], entry["body_truncated"])
+			}
+			return
+		}
+	}
+	t.Error("the upstream response wasn't logged")
+}
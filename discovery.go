@@ -1,45 +1,193 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	discoveryTimeout         = 10 * time.Second // how long a single discovery attempt may take
+	discoveryMinBackoff      = time.Second      // wait before retrying after the first failed discovery
+	discoveryMaxBackoff      = 5 * time.Minute  // the backoff doubles after each failure up to this limit
+	discoveryRefreshInterval = time.Hour        // how often discovered endpoints are discovered again
 )
 
+// TokenEndpoints discovers and remembers the token endpoints of upstream
+// registries. Registries are discovered on first use rather than at startup
+// so one unreachable registry doesn't affect the others; failed discoveries
+// are retried with exponential backoff, and discovered endpoints are
+// rediscovered in the background once they're older than
+// discoveryRefreshInterval (the previous endpoint stays in use if that fails).
+type TokenEndpoints struct {
+	mu      sync.Mutex
+	entries map[string]*tokenEndpoint // keyed by registry base URL
+	group   singleflight.Group
+	now     func() time.Time // the clock, replaced in tests
+}
+
+type tokenEndpoint struct {
+	endpoint    *WWWAuthenticateData // nil until the first successful discovery
+	err         error                // the error of the last failed discovery
+	failures    int                  // consecutive failed discoveries
+	nextAttempt time.Time            // when to retry, or to rediscover a discovered endpoint
+}
+
+// NewTokenEndpoints returns an empty TokenEndpoints
+func NewTokenEndpoints() *TokenEndpoints {
+	return &TokenEndpoints{entries: map[string]*tokenEndpoint{}, now: time.Now}
+}
+
+// Get returns the token endpoint of the registry at the given base URL (see
+// ProxyItem.RegistryURL), discovering it if
+// necessary; while a failed discovery is backing off, the error of the last
+// attempt is returned without contacting the registry
+func (te *TokenEndpoints) Get(ctx context.Context, registryURL string) (*WWWAuthenticateData, error) {
+	te.mu.Lock()
+	entry, ok := te.entries[registryURL]
+	if !ok {
+		entry = &tokenEndpoint{}
+		te.entries[registryURL] = entry
+	}
+	endpoint, lastErr := entry.endpoint, entry.err
+	due := !te.now().Before(entry.nextAttempt)
+	if endpoint != nil && due {
+		// rediscover in the background, meanwhile keep using the endpoint
+		entry.nextAttempt = te.now().Add(discoveryRefreshInterval)
+		go te.discover(context.WithoutCancel(ctx), registryURL) //nolint
+	}
+	te.mu.Unlock()
+
+	switch {
+	case endpoint != nil:
+		return endpoint, nil
+	case !due:
+		return nil, lastErr
+	}
+	return te.discover(ctx, registryURL)
+}
+
+// Known returns true if the token endpoint of the registry at the given base
+// URL has been looked up before, whether or not that succeeded
+func (te *TokenEndpoints) Known(registryURL string) bool {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	_, ok := te.entries[registryURL]
+	return ok
+}
+
+// ForProxy returns the token endpoint to use for the given proxy: its
+// configured token_realm and token_service, or else the discovered endpoint
+// of its registry
+func (te *TokenEndpoints) ForProxy(ctx context.Context, proxy ProxyItem) (*WWWAuthenticateData, error) {
+	if proxy.TokenRealm != "" {
+		return &WWWAuthenticateData{Realm: proxy.TokenRealm, Service: proxy.TokenService}, nil
+	}
+	return te.Get(ctx, proxy.RegistryURL())
+}
+
+// discover runs DiscoverTokenEndpoint for the given registry and records the
+// outcome; concurrent calls for the same registry share one attempt
+func (te *TokenEndpoints) discover(ctx context.Context, registryURL string) (*WWWAuthenticateData, error) {
+	result, err, _ := te.group.Do(registryURL, func() (any, error) {
+		// the attempt is shared, so it mustn't be cancelled with one client's request
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), discoveryTimeout)
+		defer cancel()
+		endpoint, err := DiscoverTokenEndpoint(ctx, registryURL)
+
+		te.mu.Lock()
+		defer te.mu.Unlock()
+		entry := te.entries[registryURL]
+		if err != nil {
+			entry.failures++
+			backoff := discoveryMaxBackoff
+			if entry.failures < 16 {
+				backoff = min(discoveryMinBackoff<<(entry.failures-1), discoveryMaxBackoff)
+			}
+			entry.err = err
+			entry.nextAttempt = te.now().Add(backoff)
+			discoveryLogger.Warn("TokenEndpoints.discover: discovery failed", "registry", registryURL, "failures", entry.failures, "retry_in", backoff, "error", err)
+			if entry.endpoint != nil {
+				return entry.endpoint, nil
+			}
+			return nil, err
+		}
+		entry.endpoint = endpoint
+		entry.err = nil
+		entry.failures = 0
+		entry.nextAttempt = te.now().Add(discoveryRefreshInterval)
+		return endpoint, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*WWWAuthenticateData), nil
+}
+
 // ServeServiceDiscoveryEndpoint serves the `/v2/` endpoint with some special handling
 func ServeServiceDiscoveryEndpoint(w http.ResponseWriter, r *http.Request) {
-	LogRequest("ServeServiceDiscoveryEndpoint: received the following request", r)
+	LogRequest(discoveryLogger, "ServeServiceDiscoveryEndpoint: received the following request", r)
 
 	// Set JSON content type and WWW-Authenticate header
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/_token",service="%s"`, r.Host, r.Host))
+	w.Header().Set("Www-Authenticate", WWWAuthenticateData{Realm: fmt.Sprintf("https://%s/_token", r.Host), Service: r.Host}.String())
 
 	// Return unauthorized response with JSON error
 	http.Error(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required","detail":null}]}`, http.StatusUnauthorized)
 }
 
-// DiscoverTokenEndpoint attempts to get the URL of the remote token service for the given registry;
-// for example with docker hub the result is "https://auth.docker.io/token"
-func DiscoverTokenEndpoint(registryHost string) (*WWWAuthenticateData, error) {
-	url := fmt.Sprintf("https://%s/v2/", registryHost)
-	logger.Debug("DiscoverTokenEndpoint: making request", "url", url)
-	resp, err := http.Get(url)
-	LogResponse("DiscoverTokenEndpoint: received response", resp)
+// DiscoverTokenEndpoint attempts to get the URL of the remote token service for the registry at the
+// given base URL; for example with docker hub the result is "https://auth.docker.io/token"
+func DiscoverTokenEndpoint(ctx context.Context, registryURL string) (*WWWAuthenticateData, error) {
+	_, registryHost, _ := strings.Cut(registryURL, "://")
+	ctx, span := tracer.Start(ctx, "DiscoverTokenEndpoint", trace.WithAttributes(attrUpstreamHost.String(registryHost)))
+	endpoint, err := discoverTokenEndpoint(ctx, registryURL)
+	if err != nil {
+		metricDiscoveryFailures.WithLabelValues(registryHost).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return endpoint, err
+}
+
+func discoverTokenEndpoint(ctx context.Context, registryURL string) (*WWWAuthenticateData, error) {
+	url := registryURL + "/v2/"
+	discoveryLogger.Debug("DiscoverTokenEndpoint: making request", "url", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("DiscoverTokenEndpoint: failed to build request for %s: %+v", registryURL, err)
+	}
+	InjectTraceContext(req)
+	resp, err := http.DefaultClient.Do(req)
+	LogResponse(discoveryLogger, "DiscoverTokenEndpoint: received response", resp)
 	if err != nil {
-		return nil, fmt.Errorf("DiscoverTokenEndpoint: failed to query the registry host %s: %+v", registryHost, err)
+		return nil, fmt.Errorf("DiscoverTokenEndpoint: failed to query the registry host %s: %+v", registryURL, err)
 	}
+	defer resp.Body.Close() //nolint
 
-	authHeader := resp.Header.Get("www-authenticate")
-	if authHeader == "" {
+	authHeaders := resp.Header.Values("www-authenticate")
+	if len(authHeaders) == 0 {
 		return nil, fmt.Errorf("DiscoverTokenEndpoint: www-authenticate header not returned from %s, cannot locate token endpoint", url)
 	}
-	authHeaderFields, ok := ParseWWWAuthenticate(authHeader)
+	authHeaderFields, ok := ParseWWWAuthenticate(authHeaders...)
 	if !ok {
-		return nil, fmt.Errorf("DiscoverTokenEndpoint: www-authenticate header could not be parsed; header: %s", authHeader)
+		return nil, fmt.Errorf("DiscoverTokenEndpoint: www-authenticate header has no Bearer or Basic challenge; header: %s", strings.Join(authHeaders, ", "))
+	}
+	if authHeaderFields.IsBearer() && authHeaderFields.Realm == "" {
+		return nil, fmt.Errorf("DiscoverTokenEndpoint: www-authenticate header has no realm, cannot locate token endpoint; header: %s", strings.Join(authHeaders, ", "))
 	}
 
-	logger.Debug("DiscoverTokenEndpoint: DEBUG: parsed www-authenticate header", "header", authHeaderFields)
-	logger.Info("DiscoverTokenEndpoint: discovered endpoint",
-		"registry", registryHost,
+	discoveryLogger.Debug("DiscoverTokenEndpoint: DEBUG: parsed www-authenticate header", "header", authHeaderFields)
+	discoveryLogger.Info("DiscoverTokenEndpoint: discovered endpoint",
+		"registry", registryURL,
 		"endpoint", authHeaderFields.Realm)
 	return &authHeaderFields, nil
 }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock for TokenEndpoints which only moves when told to
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// checkDiscoveries checks how many times the upstream was asked for its
+// token endpoint
+func checkDiscoveries(t *testing.T, upstream *testUpstream, want int) {
+	t.Helper()
+	if got := len(upstream.Requests("/v2/")); got != want {
+		t.Fatalf("registry was asked for its token endpoint %d times, want %d", got, want)
+	}
+}
+
+func newTestTokenEndpoints() (*TokenEndpoints, *testClock) {
+	clock := &testClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	te := NewTokenEndpoints()
+	te.now = clock.Now
+	return te, clock
+}
+
+func TestTokenEndpointsLazyDiscovery(t *testing.T) {
+	registry := newTestUpstream(t, http.NotFound)
+	te, _ := newTestTokenEndpoints()
+	checkDiscoveries(t, registry, 0)
+
+	for range 3 {
+		endpoint, err := te.Get(context.Background(), registry.URL)
+		if err != nil || endpoint.Realm != registry.URL+"/token" || endpoint.Service != "upstream" {
+			t.Fatalf("Get() = %+v, %v", endpoint, err)
+		}
+	}
+	checkDiscoveries(t, registry, 1)
+}
+
+func TestTokenEndpointsBackoff(t *testing.T) {
+	registry := newTestUpstream(t, http.NotFound)
+	registry.FailNext(math.MaxInt)
+	te, clock := newTestTokenEndpoints()
+
+	_, firstErr := te.Get(context.Background(), registry.URL)
+	if firstErr == nil {
+		t.Fatal("Get() succeeded while the registry is down")
+	}
+	checkDiscoveries(t, registry, 1)
+
+	// while backing off the last error is returned without asking the registry
+	clock.Advance(999 * time.Millisecond)
+	if _, err := te.Get(context.Background(), registry.URL); err != firstErr {
+		t.Errorf("Get() while backing off = %v, want the last error %v", err, firstErr)
+	}
+	checkDiscoveries(t, registry, 1)
+
+	// the backoff doubles from 1s after each failure, up to 5m
+	backoffs := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second,
+		32 * time.Second, 64 * time.Second, 128 * time.Second, 256 * time.Second, 5 * time.Minute, 5 * time.Minute}
+	clock.Advance(time.Millisecond)
+	for i, backoff := range backoffs[1:] {
+		if _, err := te.Get(context.Background(), registry.URL); err == nil {
+			t.Fatal("Get() succeeded while the registry is down")
+		}
+		checkDiscoveries(t, registry, i+2)
+		clock.Advance(backoff - time.Millisecond)
+		te.Get(context.Background(), registry.URL) //nolint
+		checkDiscoveries(t, registry, i+2)
+		clock.Advance(time.Millisecond)
+	}
+
+	// once the registry is back it's discovered on the next attempt
+	registry.FailNext(0)
+	if endpoint, err := te.Get(context.Background(), registry.URL); err != nil || endpoint.Realm != registry.URL+"/token" {
+		t.Fatalf("Get() after the registry recovered = %+v, %v", endpoint, err)
+	}
+	checkDiscoveries(t, registry, len(backoffs)+1)
+}
+
+func TestTokenEndpointsRefresh(t *testing.T) {
+	registry := newTestUpstream(t, http.NotFound)
+	te, clock := newTestTokenEndpoints()
+	discovered, err := te.Get(context.Background(), registry.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an old endpoint is rediscovered in the background; if that fails the
+	// endpoint stays in use
+	registry.FailNext(math.MaxInt)
+	clock.Advance(discoveryRefreshInterval)
+	if endpoint, err := te.Get(context.Background(), registry.URL); endpoint != discovered || err != nil {
+		t.Errorf("Get() while refreshing = %+v, %v; want the known endpoint", endpoint, err)
+	}
+	// wait for the background rediscovery to reach the registry
+	deadline := time.Now().Add(5 * time.Second)
+	for len(registry.Requests("/v2/")) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	checkDiscoveries(t, registry, 2)
+	if endpoint, err := te.Get(context.Background(), registry.URL); endpoint != discovered || err != nil {
+		t.Errorf("Get() after a failed refresh = %+v, %v; want the known endpoint", endpoint, err)
+	}
+}
+
+// clients get a 503 while the token endpoint of a registry is unknown
+func TestUndiscoveredRegistryUnavailable(t *testing.T) {
+	registry := newTestUpstream(t, http.NotFound)
+	registry.FailNext(math.MaxInt)
+	server := newTestHandler(t, "proxies:\n  \"a/\":\n    registry: "+registry.URL+"\n    remote: org\n")
+	// the server may already be discovering the registry in the background
+	clock := &testClock{now: time.Now()}
+	server.endpoints.mu.Lock()
+	server.endpoints.now = clock.Now
+	server.endpoints.mu.Unlock()
+	front := httptest.NewServer(server)
+	t.Cleanup(front.Close)
+
+	for _, path := range []string{"/_token?service=reg.example.com&scope=repository:a/app:pull", "/v2/a/app/manifests/latest"} {
+		resp := doRequest(t, front, http.MethodGet, path, "")
+		if regErr := readRegistryError(t, resp); regErr.Status != http.StatusServiceUnavailable || regErr.Code != errCodeUnavailable {
+			t.Errorf("GET %s: %d %s, want 503 %s", path, regErr.Status, regErr.Code, errCodeUnavailable)
+		}
+	}
+	checkDiscoveries(t, registry, 1)
+
+	registry.FailNext(0)
+	clock.Advance(discoveryMinBackoff)
+	if status, token := getToken(t, front, "scope=repository:a/app:pull", "", ""); status != http.StatusOK || token == "" {
+		t.Errorf("token request after the registry recovered: status %d", status)
+	}
+}
+
+// a configured token realm and service are used instead of discovering them
+func TestStaticTokenRealm(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) //nolint
+	})
+	front := newTestServer(t, "proxies:\n"+proxyYAML("a/", upstream, "org",
+		"token_realm: "+upstream.URL+"/token",
+		"token_service: static-service"))
+
+	status, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	if status != http.StatusOK || token == "" {
+		t.Fatalf("token status %d", status)
+	}
+	if resp := doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", token); resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if requests := upstream.Requests("/v2/"); len(requests) != 0 {
+		t.Errorf("registry was asked for its token endpoint %d times, want 0", len(requests))
+	}
+	requests := upstream.Requests("/token")
+	if len(requests) != 1 {
+		t.Fatalf("%d upstream token requests, want 1", len(requests))
+	}
+	if service := requests[0].URL.Query().Get("service"); service != "static-service" {
+		t.Errorf("upstream token request for service %q, want static-service", service)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// error codes from the distribution spec, see:
+// https://distribution.github.io/distribution/spec/api/#errors-2
+const (
+	errCodeUnauthorized string = "UNAUTHORIZED"
+	errCodeDenied       string = "DENIED"
+	errCodeNameUnknown  string = "NAME_UNKNOWN"
+	errCodeUnsupported  string = "UNSUPPORTED"
+	errCodeTooMany      string = "TOOMANYREQUESTS"
+	errCodeUnavailable  string = "UNAVAILABLE" // not in the spec, but used by the reference implementation for 503s
+	errCodeUnknown      string = "UNKNOWN"     // not in the spec, but used by the reference implementation for other failures
+)
+
+// RegistryError is an error which can be returned to docker clients in the
+// JSON error format described by the distribution spec
+type RegistryError struct {
+	Status    int    // the HTTP status code for the response
+	Code      string // e.g. "UNAUTHORIZED"
+	Message   string // human-readable description of the problem
+	Challenge string // optional value for the Www-Authenticate header
+}
+
+// NewRegistryError returns a RegistryError with the given status, code and message
+func NewRegistryError(status int, code, message string) *RegistryError {
+	return &RegistryError{
+		Status:  status,
+		Code:    code,
+		Message: message,
+	}
+}
+
+// Error returns a string describing the error
+func (re *RegistryError) Error() string {
+	return fmt.Sprintf("%d %s: %s", re.Status, re.Code, re.Message)
+}
+
+// Body returns the JSON-encoded error body
+func (re *RegistryError) Body() []byte {
+	type errorItem struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Detail  any    `json:"detail"`
+	}
+	body, _ := json.Marshal(struct {
+		Errors []errorItem `json:"errors"`
+	}{
+		Errors: []errorItem{{Code: re.Code, Message: re.Message}},
+	})
+	return body
+}
+
+// Response returns an *http.Response containing the error, suitable for
+// returning from a RoundTrip function
+func (re *RegistryError) Response(req *http.Request) *http.Response {
+	body := re.Body()
+	resp := NewResponse(req, re.Status, "application/json", io.NopCloser(bytes.NewReader(body)), int64(len(body)))
+	if re.Challenge != "" {
+		resp.Header.Set("Www-Authenticate", re.Challenge)
+	}
+	return resp
+}
+
+// Write sends the error to the given http.ResponseWriter
+func (re *RegistryError) Write(w http.ResponseWriter) {
+	body := re.Body()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
+	if re.Challenge != "" {
+		w.Header().Set("Www-Authenticate", re.Challenge)
+	}
+	w.WriteHeader(re.Status)
+	w.Write(body) //nolint
+}
+
+// UpstreamError returns the RegistryError to send to clients when the named
+// upstream service answered with the given unexpected status
+func UpstreamError(status int, service string) *RegistryError {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return NewRegistryError(http.StatusForbidden, errCodeDenied, fmt.Sprintf("%s denied access (status %d)", service, status))
+	case status == http.StatusTooManyRequests:
+		return NewRegistryError(http.StatusTooManyRequests, errCodeTooMany, fmt.Sprintf("%s is rate limiting requests", service))
+	case status >= http.StatusInternalServerError:
+		return NewRegistryError(http.StatusServiceUnavailable, errCodeUnavailable, fmt.Sprintf("%s is unavailable (status %d)", service, status))
+	default:
+		return NewRegistryError(http.StatusBadGateway, errCodeUnknown, fmt.Sprintf("%s answered with unexpected status %d", service, status))
+	}
+}
+
+// ErrorFor returns the RegistryError to send to clients for an error which
+// occurred while proxying their request; RegistryErrors anywhere in the chain
+// are used as they are, network failures and timeouts are reported as the
+// upstream registry being unavailable
+func ErrorFor(err error) *RegistryError {
+	var regErr *RegistryError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &regErr):
+		return regErr
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr):
+		return NewRegistryError(http.StatusServiceUnavailable, errCodeUnavailable, "the upstream registry is unavailable")
+	default:
+		return NewRegistryError(http.StatusBadGateway, errCodeUnknown, "unexpected error while contacting the upstream registry")
+	}
+}
+
+// ErrorHandler returns an httputil.ReverseProxy ErrorHandler which answers
+// failed requests with registry errors rather than a bare 502
+func ErrorHandler(log *slog.Logger) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, req *http.Request, err error) {
+		if errors.Is(err, context.Canceled) && req.Context().Err() != nil {
+			log.Debug("ErrorHandler: client went away", "url", req.URL, "error", err)
+			return
+		}
+		regErr := ErrorFor(err)
+		log.Warn("ErrorHandler: request failed", "url", req.URL, "status", regErr.Status, "code", regErr.Code, "error", err)
+		regErr.Write(w)
+	}
+}
+
+type directorErrorKey struct{}
+
+// SetDirectorError records the error a Director ran into on the outgoing
+// request; Directors can't return errors, so the RoundTrip function answers
+// with it (see DirectorError) instead of sending the request
+func SetDirectorError(req *http.Request, regErr *RegistryError) {
+	*req = *req.WithContext(context.WithValue(req.Context(), directorErrorKey{}, regErr))
+}
+
+// DirectorError returns the error recorded by SetDirectorError, or nil
+func DirectorError(req *http.Request) *RegistryError {
+	regErr, _ := req.Context().Value(directorErrorKey{}).(*RegistryError)
+	return regErr
+}
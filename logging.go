@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// valid values of the log_format setting
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// loggers of the components whose level can be set separately from the
+// global level, see SetupLogging
+var (
+	tokenLogger     *slog.Logger // the token endpoint and token cache
+	registryLogger  *slog.Logger // registry requests and the blob and manifest caches
+	discoveryLogger *slog.Logger // token endpoint discovery
+)
+
+// startupLogLevel is the global log level given on the command line; it
+// applies whenever the configuration doesn't set log_level
+var startupLogLevel = "INFO"
+
+// componentLevels are the log levels of the components, by name
+var componentLevels = map[string]*componentLevel{
+	"token":     {},
+	"registry":  {},
+	"discovery": {},
+}
+
+// componentLevel is the log level of a component; it follows the global log
+// level unless it has been set
+type componentLevel struct {
+	mu    sync.RWMutex
+	level *slog.Level
+}
+
+// Level implements slog.Leveler
+func (cl *componentLevel) Level() slog.Level {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	if cl.level == nil {
+		return logLevel.Level()
+	}
+	return *cl.level
+}
+
+// Set sets the level of the component, nil makes it follow the global level
+func (cl *componentLevel) Set(level *slog.Level) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.level = level
+}
+
+// String returns the name of the level set for the component, or an empty
+// string if it follows the global level
+func (cl *componentLevel) String() string {
+	cl.mu.RLock()
+	defer cl.mu.RUnlock()
+	if cl.level == nil {
+		return ""
+	}
+	return cl.level.String()
+}
+
+// levelHandler is a slog.Handler which filters records by its own level
+// before passing them on, so loggers sharing a handler can have different
+// levels
+type levelHandler struct {
+	handler slog.Handler
+	level   slog.Leveler
+}
+
+func (h levelHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h levelHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler.Handle(ctx, record)
+}
+
+func (h levelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return levelHandler{handler: h.handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h levelHandler) WithGroup(name string) slog.Handler {
+	return levelHandler{handler: h.handler.WithGroup(name), level: h.level}
+}
+
+// SetupLogging creates the global and component loggers, writing to stderr
+// in the given format
+func SetupLogging(format string) {
+	options := &slog.HandlerOptions{Level: slog.LevelDebug} // levels are checked by levelHandler
+	var handler slog.Handler
+	if format == logFormatJSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	logger = slog.New(levelHandler{handler: handler, level: logLevel})
+	tokenLogger = slog.New(levelHandler{handler: handler, level: componentLevels["token"]}).With("component", "token")
+	registryLogger = slog.New(levelHandler{handler: handler, level: componentLevels["registry"]}).With("component", "registry")
+	discoveryLogger = slog.New(levelHandler{handler: handler, level: componentLevels["discovery"]}).With("component", "discovery")
+}
+
+// ParseLogLevel returns the level with the given name, one of DEBUG, INFO,
+// WARN or ERROR (in any case)
+func ParseLogLevel(name string) (slog.Level, error) {
+	switch strings.ToUpper(name) {
+	case "DEBUG":
+		return slog.LevelDebug, nil
+	case "INFO":
+		return slog.LevelInfo, nil
+	case "WARN":
+		return slog.LevelWarn, nil
+	case "ERROR":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level \"%s\", must be one of: DEBUG, INFO, WARN, ERROR", name)
+}
+
+// setLogLevel sets the global log level
+func setLogLevel(name string) error {
+	level, err := ParseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+// LogLevels describes the global and component log levels; it's the body of
+// requests to and responses from the log level admin endpoint
+type LogLevels struct {
+	Level      string            `json:"level"`      // the global level; left unchanged if empty
+	Components map[string]string `json:"components"` // component levels; an empty level makes the component follow the global level
+}
+
+// CurrentLogLevels returns the log levels in effect
+func CurrentLogLevels() LogLevels {
+	levels := LogLevels{Level: logLevel.Level().String(), Components: map[string]string{}}
+	for name, level := range componentLevels {
+		levels.Components[name] = level.String()
+	}
+	return levels
+}
+
+// Validate checks the level and component names
+func (ll LogLevels) Validate() error {
+	if ll.Level != "" {
+		if _, err := ParseLogLevel(ll.Level); err != nil {
+			return err
+		}
+	}
+	for name, level := range ll.Components {
+		if _, ok := componentLevels[name]; !ok {
+			return fmt.Errorf("unknown log component \"%s\", must be one of: %s", name, strings.Join(slices.Sorted(maps.Keys(componentLevels)), ", "))
+		}
+		if level == "" {
+			continue
+		}
+		if _, err := ParseLogLevel(level); err != nil {
+			return fmt.Errorf("log component %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Apply validates the levels and then puts them into effect; components
+// which aren't mentioned keep their level
+func (ll LogLevels) Apply() error {
+	if err := ll.Validate(); err != nil {
+		return err
+	}
+	if ll.Level != "" {
+		setLogLevel(ll.Level) //nolint
+	}
+	for name, levelName := range ll.Components {
+		if levelName == "" {
+			componentLevels[name].Set(nil)
+			continue
+		}
+		level, _ := ParseLogLevel(levelName) // validated above
+		componentLevels[name].Set(&level)
+	}
+	return nil
+}
+
+// LogLevelHandler serves the admin endpoint which reports (GET) and changes
+// (PUT or POST) the log levels; only the configured admins may use it
+type LogLevelHandler struct {
+	Admin AdminConfig
+	Auth  *Authenticator
+	FQDN  string
+}
+
+func (h *LogLevelHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	identity, err := h.Auth.Authenticate(req)
+	if err != nil || identity == nil {
+		logger.Info("LogLevelHandler.ServeHTTP: client authentication failed", "error", err)
+		BasicChallenge(h.FQDN, "authentication required").Write(rw)
+		return
+	}
+	AccessLogEntryFrom(req.Context()).Identity = identity.String()
+	if !h.Auth.Allowed(identity, h.Admin.Users, h.Admin.Groups, h.Admin.Claims) {
+		logger.Info("LogLevelHandler.ServeHTTP: client is not an admin", "identity", identity.String())
+		NewRegistryError(http.StatusForbidden, errCodeDenied, fmt.Sprintf("%s may not change log levels", identity)).Write(rw)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPut, http.MethodPost:
+		var levels LogLevels
+		if err := json.NewDecoder(req.Body).Decode(&levels); err != nil {
+			http.Error(rw, fmt.Sprintf("invalid request body: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := levels.Validate(); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("LogLevelHandler.ServeHTTP: changing log levels", "identity", identity.String(), "level", levels.Level, "components", levels.Components)
+		levels.Apply() //nolint
+	default:
+		rw.Header().Set("Allow", "GET, HEAD, PUT, POST")
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(CurrentLogLevels()) //nolint
+}
@@ -17,20 +17,26 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
-	"aidanwoods.dev/go-paseto"
 	"github.com/urfave/cli/v2"
 )
 
 const (
 	proxyConfigHeader     string = "X-Proxy-Config"
+	proxyScopeHeader      string = "X-Proxy-Scope"
+	proxyLoginHeader      string = "X-Proxy-Login"
 	tokenKeyUpstreamToken string = "upstream-token"
+	tokenKeyProxies       string = "proxies"  // the LocalPrefixes of the ProxyItems the token was issued for
+	tokenKeyRegistry      string = "registry" // the RegistryHost of the ProxyItems the token was issued for
+	tokenKeyScopes        string = "scopes"   // the resource scopes (in local terms) granted to the token
 )
 
 var (
@@ -40,9 +46,8 @@ var (
 	date    = "unknown"
 	builtBy = "unknown"
 
-	tokenEndpoints = map[string]*WWWAuthenticateData{} // mapping of registryHosts to token endpoint URLs
-	logger         *slog.Logger
-	logLevel       *slog.LevelVar
+	logger   *slog.Logger // the global logger, see SetupLogging for the component loggers
+	logLevel *slog.LevelVar
 )
 
 func init() {
@@ -71,13 +76,11 @@ func main() {
 			},
 		},
 		Action: func(ctx *cli.Context) error {
-			setLogLevel(ctx.String("loglevel"))
-			logger = slog.New(slog.NewTextHandler(
-				os.Stderr,
-				&slog.HandlerOptions{
-					Level: logLevel,
-				}),
-			)
+			if err := setLogLevel(ctx.String("loglevel")); err != nil {
+				return err
+			}
+			startupLogLevel = ctx.String("loglevel")
+			SetupLogging(logFormatText)
 			logger.Info("registryproxy starting up",
 				"version", version,
 				"commit", commit,
@@ -101,50 +104,70 @@ func Serve(configPath string) {
 		logger.Error("config loading error", "error", err)
 		os.Exit(1)
 	}
+	SetupLogging(config.LogFormat)
+	config.ApplyLogSettings()
 	config.Log()
 
-	// the secret key is used to process the PASETO tokens we issue to clients
-	if config.SecretKey == "" {
-		logger.Error("SecretKey not found in config")
+	shutdownTracing, err := SetupTracing(config.Tracing)
+	if err != nil {
+		logger.Error("unable to set up tracing", "error", err)
 		os.Exit(1)
 	}
-	pasetoSecretKey, err := paseto.V4SymmetricKeyFromHex(config.SecretKey)
+	defer shutdownTracing(context.Background()) //nolint
+
+	accessLog, err := NewAccessLog(config.AccessLog)
 	if err != nil {
-		logger.Error("Failed to parse PASETO symmetric key", "err", err)
+		logger.Error("unable to set up access log", "error", err)
 		os.Exit(1)
 	}
 
-	// set up http handlers for each proxy
-	mux := http.NewServeMux()
-	mux.Handle("/_token", NewTokenProxy(config, pasetoSecretKey))
-	mux.HandleFunc("/v2/", ServeServiceDiscoveryEndpoint) // handles exactly "/v2/" (nothing under it)
-
-	for _, proxy := range config.Proxies {
-		if _, ok := tokenEndpoints[proxy.RegistryHost]; !ok {
-			// if the token endpoint for the given RegistryHost isn't in
-			// tokenEndpoints we look it up, then add it
-			endpoint, err := DiscoverTokenEndpoint(proxy.RegistryHost)
-			if err != nil {
-				logger.Error("unable to discover token endpoint", "registry", proxy.RegistryHost, "error", err)
-				os.Exit(1)
-
-			}
-			tokenEndpoints[proxy.RegistryHost] = endpoint
-		}
-
-		proxyPath := fmt.Sprintf("/v2/%s/", strings.Trim(proxy.LocalPrefix, "/"))
-		logger.Info("setup handler", "path", proxyPath, "proxy", proxy.LocalPrefix)
-		mux.Handle(proxyPath, NewRegistryProxy(proxy, pasetoSecretKey, config.ProxyFQDN))
+	server, err := NewServer(configPath, config)
+	if err != nil {
+		logger.Error("unable to set up server", "error", err)
+		os.Exit(1)
+	}
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		metricsServer = NewMetricsServer(config.MetricsAddr)
+		go ServeMetrics(metricsServer)
+	}
+	go server.WatchSignals()
+	if config.WatchConfig {
+		go server.WatchFile(configPollInterval)
 	}
 
 	// serve
 	hostport := fmt.Sprintf("%s:%s", config.ListenAddr, config.ListenPort)
-	logger.Info("listening for network connections", "addr", hostport)
-
-	if err := http.ListenAndServe(hostport, PanicLogger(mux)); err != http.ErrServerClosed {
+	httpServer := &http.Server{
+		Addr:    hostport,
+		Handler: accessLog.Wrap(PanicLogger(TraceRequests(server))),
+	}
+	listenErrors := make(chan error, 1)
+	go func() {
+		logger.Info("listening for network connections", "addr", hostport)
+		listenErrors <- httpServer.ListenAndServe()
+	}()
+
+	// wait for a shutdown signal (or for the listener to fail)
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	select {
+	case err := <-listenErrors:
 		logger.Error("unable to start network listener", "error", err)
 		os.Exit(1)
+	case <-signals.Done():
+		stop() // a second signal terminates the process immediately
+	}
 
+	// the metrics stay available while the main listener drains
+	err = server.Shutdown(httpServer, metricsServer)
+	if closeErr := accessLog.Close(); closeErr != nil {
+		logger.Error("unable to close access log", "error", closeErr)
+	}
+	if err != nil {
+		logger.Error("unable to shut down cleanly", "error", err)
+		shutdownTracing(context.Background()) //nolint
+		os.Exit(1)
 	}
 
 	logger.Info("server shutdown successfully")
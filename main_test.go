@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testSecretKey = "796280902778385984e2acd2868447a0ee703a8fab0ed7e69103cd50b9e3cddd"
+
+func TestMain(m *testing.M) {
+	logLevel.Set(slog.LevelError)
+	startupLogLevel = "ERROR" // reloads without log_level return to it
+	SetupLogging(logFormatText)
+	os.Exit(m.Run())
+}
+
+// writeTestFile writes the contents into a file in the test's temporary
+// directory and returns its path
+func writeTestFile(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestServer starts a proxy using the given configuration, to which the
+// secret key and proxy_fqdn are added
+func newTestServer(t *testing.T, configYAML string) *httptest.Server {
+	t.Helper()
+	front := httptest.NewServer(newTestHandler(t, configYAML))
+	t.Cleanup(front.Close)
+	return front
+}
+
+// newTestHandler returns the Server for the given configuration, to which
+// the secret key and proxy_fqdn are added
+func newTestHandler(t *testing.T, configYAML string) *Server {
+	t.Helper()
+	path := writeTestFile(t, "config.yaml", "secret_key: "+testSecretKey+"\nproxy_fqdn: reg.example.com\n"+configYAML)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	server, err := NewServer(path, config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	return server
+}
+
+// testUpstream is a stand-in for an upstream registry with a token service;
+// it issues the token "upstream-token" and hands requests carrying that
+// token to its handler, other requests get a Bearer challenge
+type testUpstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	requests []*http.Request // every request received, in order
+	failures int             // number of upcoming requests to fail with a 503
+}
+
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *testUpstream {
+	t.Helper()
+	upstream := &testUpstream{}
+	upstream.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		upstream.requests = append(upstream.requests, r.Clone(r.Context()))
+		fail := upstream.failures > 0
+		if fail {
+			upstream.failures--
+		}
+		upstream.mu.Unlock()
+		switch {
+		case fail:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case r.URL.Path == "/token":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"token":"upstream-token","expires_in":300}`) //nolint
+		case r.Header.Get("Authorization") != "Bearer upstream-token":
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="upstream"`, upstream.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			handler(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream
+}
+
+// FailNext makes the upstream answer its next n requests with a 503, whatever
+// they ask for; FailNext(0) brings it back up
+func (u *testUpstream) FailNext(n int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.failures = n
+}
+
+// Requests returns the requests received with the given path
+func (u *testUpstream) Requests(path string) []*http.Request {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := []*http.Request{}
+	for _, req := range u.requests {
+		if req.URL.Path == path {
+			result = append(result, req)
+		}
+	}
+	return result
+}
+
+// getToken requests a token for the given query from the proxy, using basic
+// auth if a user is given; it returns the status and the token
+func getToken(t *testing.T, front *httptest.Server, query, user, password string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, front.URL+"/_token?service=reg.example.com&"+query, nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close() //nolint
+	var tokenResponse TokenResponse
+	json.NewDecoder(resp.Body).Decode(&tokenResponse) //nolint
+	return resp.StatusCode, tokenResponse.Token
+}
+
+// doRequest sends a registry API request to the proxy with the given token
+func doRequest(t *testing.T, front *httptest.Server, method, path, token string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, front.URL+path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() }) //nolint
+	return resp
+}
+
+// proxyYAML returns the configuration of a proxy named name, forwarding to
+// the remote namespace of the upstream registry; extra lines are indented
+// into the proxy
+func proxyYAML(name string, upstream *testUpstream, remote string, extra ...string) string {
+	lines := []string{
+		fmt.Sprintf("  %q:", name),
+		"    registry: " + upstream.URL,
+		"    remote: " + remote,
+	}
+	for _, line := range extra {
+		lines = append(lines, "    "+line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// readRegistryError decodes the first error in a registry error response body
+func readRegistryError(t *testing.T, resp *http.Response) *RegistryError {
+	t.Helper()
+	var body struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || len(body.Errors) == 0 {
+		t.Fatalf("response has no registry error; error: %v", err)
+	}
+	return NewRegistryError(resp.StatusCode, body.Errors[0].Code, body.Errors[0].Message)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestMaxSize is the largest manifest we'll cache, the distribution spec
+// allows registries to reject manifests larger than this
+const manifestMaxSize = 4 << 20
+
+// CachedManifest is a manifest stored in the ManifestCache
+type CachedManifest struct {
+	Key         string
+	Body        []byte
+	ContentType string
+	Digest      string
+	FetchedAt   time.Time // when the manifest was last fetched or revalidated
+}
+
+// ManifestCache is an in-memory least-recently-used cache of manifests.
+// Manifests requested by digest never change so they are cached until they
+// are evicted; manifests requested by tag are revalidated with the upstream
+// registry once they're older than the proxy's manifest TTL.
+type ManifestCache struct {
+	MaxEntries int
+
+	mu      sync.Mutex
+	lru     *list.List               // of *CachedManifest; most recently used at the front
+	entries map[string]*list.Element // key -> element in lru
+}
+
+// NewManifestCache returns an empty ManifestCache
+func NewManifestCache(maxEntries int) *ManifestCache {
+	return &ManifestCache{
+		MaxEntries: maxEntries,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// ManifestCacheKey returns the cache key for a manifest request; responses
+// for tags depend on the media types the client accepts so the Accept header
+// is part of the key. Manifests are only served to proxies using the
+// credentials they were fetched with, so private repositories stay private.
+// registryURL is the base URL of the upstream, see ProxyItem.RegistryURL.
+func ManifestCacheKey(registryURL, path, reference, accept, credential string) string {
+	credentialHash := sha256.Sum256([]byte(credential))
+	key := registryURL + path + "\x00" + hex.EncodeToString(credentialHash[:])
+	if IsDigest(reference) {
+		return key
+	}
+	return key + "\x00" + accept
+}
+
+// Get returns a copy of the cached manifest with the given key
+func (mc *ManifestCache) Get(key string) (CachedManifest, bool) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	element, found := mc.entries[key]
+	if !found {
+		return CachedManifest{}, false
+	}
+	mc.lru.MoveToFront(element)
+	return *element.Value.(*CachedManifest), true
+}
+
+// Put adds or replaces a manifest in the cache
+func (mc *ManifestCache) Put(manifest CachedManifest) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if element, found := mc.entries[manifest.Key]; found {
+		element.Value = &manifest
+		mc.lru.MoveToFront(element)
+		return
+	}
+	mc.entries[manifest.Key] = mc.lru.PushFront(&manifest)
+	for mc.lru.Len() > mc.MaxEntries {
+		oldest := mc.lru.Remove(mc.lru.Back()).(*CachedManifest)
+		delete(mc.entries, oldest.Key)
+	}
+}
+
+// Touch marks the cached manifest with the given key as freshly revalidated
+func (mc *ManifestCache) Touch(key string) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if element, found := mc.entries[key]; found {
+		element.Value.(*CachedManifest).FetchedAt = time.Now()
+	}
+}
+
+// Response returns a response serving the cached manifest
+func (cm CachedManifest) Response(req *http.Request) *http.Response {
+	resp := NewResponse(req, http.StatusOK, cm.ContentType, io.NopCloser(bytes.NewReader(cm.Body)), int64(len(cm.Body)))
+	if req.Method == http.MethodHead {
+		resp.Body = http.NoBody
+	}
+	resp.Header.Set("Docker-Content-Digest", cm.Digest)
+	resp.Header.Set("Etag", fmt.Sprintf(`"%s"`, cm.Digest))
+	return resp
+}
+
+// IsDigest returns true if the given manifest reference is a digest rather
+// than a tag (tags can't contain colons)
+func IsDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
+
+// ManifestRoundTrip performs a manifest request using the manifest cache;
+// cached manifests are served without contacting upstream while they're
+// fresh, stale tags are revalidated with If-None-Match, and if upstream fails
+// or is rate-limiting us the last known manifest is served
+func (rp *RegistryProxy) ManifestRoundTrip(req *http.Request, reference string) (*http.Response, error) {
+	key := ManifestCacheKey(rp.Config.RegistryURL(), req.URL.Path, reference, req.Header.Get("Accept"), rp.Config.AuthHeader)
+	cached, found := rp.Manifests.Get(key)
+	if found && (IsDigest(reference) || time.Since(cached.FetchedAt) < rp.Config.manifestTTL) {
+		registryLogger.Info("RegistryProxy.ManifestRoundTrip: serving manifest from cache", "url", req.URL, "digest", cached.Digest)
+		return cached.Response(req), nil
+	}
+	if found {
+		req.Header.Set("If-None-Match", fmt.Sprintf(`"%s"`, cached.Digest))
+	}
+
+	resp, err := rp.Upstream(req)
+	if found && (err != nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500) {
+		if err == nil {
+			resp.Body.Close() //nolint
+		}
+		registryLogger.Warn("RegistryProxy.ManifestRoundTrip: upstream unavailable, serving stale manifest from cache",
+			"url", req.URL,
+			"digest", cached.Digest,
+			"age", time.Since(cached.FetchedAt).Round(time.Second),
+			"error", err)
+		staleResp := cached.Response(req)
+		staleResp.Header.Set("Warning", `110 - "Response is Stale"`)
+		return staleResp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case found && resp.StatusCode == http.StatusNotModified:
+		resp.Body.Close() //nolint
+		rp.Manifests.Touch(key)
+		registryLogger.Debug("RegistryProxy.ManifestRoundTrip: cached manifest revalidated", "url", req.URL, "digest", cached.Digest)
+		return cached.Response(req), nil
+	case found && resp.StatusCode == http.StatusOK && resp.Header.Get("Docker-Content-Digest") == cached.Digest:
+		rp.Manifests.Touch(key)
+	case resp.StatusCode == http.StatusOK && req.Method == http.MethodGet && resp.ContentLength <= manifestMaxSize:
+		return rp.storeManifest(req, resp, key, reference)
+	}
+	return resp, nil
+}
+
+// storeManifest reads the manifest in the response into the cache, after
+// checking it against the expected digest
+func (rp *RegistryProxy) storeManifest(req *http.Request, resp *http.Response, key, reference string) (*http.Response, error) {
+	upstreamBody := resp.Body
+	body, err := io.ReadAll(io.LimitReader(upstreamBody, manifestMaxSize+1))
+	if err != nil {
+		upstreamBody.Close() //nolint
+		return nil, fmt.Errorf("RegistryProxy.storeManifest: unable to read manifest from upstream; error: %w", err)
+	}
+	if len(body) > manifestMaxSize {
+		// too large to cache, pass it through unchanged
+		resp.Body = ReplayBody(body, upstreamBody)
+		return resp, nil
+	}
+	upstreamBody.Close() //nolint
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	sum := sha256.Sum256(body)
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	expected := resp.Header.Get("Docker-Content-Digest")
+	if IsDigest(reference) {
+		expected = reference
+	}
+	if expected != "" && expected != digest {
+		registryLogger.Warn("RegistryProxy.storeManifest: manifest digest mismatch, not caching", "url", req.URL, "expected", expected, "actual", digest)
+		return resp, nil
+	}
+
+	rp.Manifests.Put(CachedManifest{
+		Key:         key,
+		Body:        body,
+		ContentType: resp.Header.Get("Content-Type"),
+		Digest:      digest,
+		FetchedAt:   time.Now(),
+	})
+	registryLogger.Debug("RegistryProxy.storeManifest: cached manifest", "url", req.URL, "digest", digest)
+	return resp, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testManifestType = "application/vnd.oci.image.manifest.v1+json"
+
+// testManifestUpstream is a test upstream serving one manifest for every
+// manifest request, answering If-None-Match with a 304 unless ignoreETag is
+// set; when status is set, manifest requests fail with it instead
+type testManifestUpstream struct {
+	*testUpstream
+
+	mu         sync.Mutex
+	manifest   []byte
+	digest     string
+	status     int
+	ignoreETag bool
+}
+
+func newTestManifestUpstream(t *testing.T, manifest string) *testManifestUpstream {
+	t.Helper()
+	upstream := &testManifestUpstream{}
+	upstream.SetManifest(manifest)
+	upstream.testUpstream = newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		if upstream.status != 0 {
+			w.WriteHeader(upstream.status)
+			return
+		}
+		w.Header().Set("Docker-Content-Digest", upstream.digest)
+		if !upstream.ignoreETag && r.Header.Get("If-None-Match") == fmt.Sprintf(`"%s"`, upstream.digest) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Type", testManifestType)
+		w.Write(upstream.manifest) //nolint
+	})
+	return upstream
+}
+
+// SetManifest changes the manifest served
+func (u *testManifestUpstream) SetManifest(manifest string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.digest, u.manifest = testBlob(manifest)
+}
+
+// SetStatus makes manifest requests fail with the given status, or succeed
+// again if it's 0
+func (u *testManifestUpstream) SetStatus(status int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status = status
+}
+
+// Hits returns the manifest requests with the given path that reached the
+// handler, leaving out those challenged for a token
+func (u *testManifestUpstream) Hits(path string) []*http.Request {
+	hits := []*http.Request{}
+	for _, req := range u.Requests(path) {
+		if req.Header.Get("Authorization") == "Bearer upstream-token" {
+			hits = append(hits, req)
+		}
+	}
+	return hits
+}
+
+// getManifest fetches a manifest through the proxy and checks the status of
+// the response, and its body if want is not nil
+func getManifest(t *testing.T, front *httptest.Server, path, token string, wantStatus int, want []byte) *http.Response {
+	t.Helper()
+	resp := doRequest(t, front, http.MethodGet, path, token)
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("GET %s: status %d, want %d", path, resp.StatusCode, wantStatus)
+	}
+	if want != nil && !bytes.Equal(body, want) {
+		t.Fatalf("GET %s: body %q, want %q", path, body, want)
+	}
+	return resp
+}
+
+// checkHits checks the number of manifest requests that reached upstream
+func checkHits(t *testing.T, upstream *testManifestUpstream, path string, want int) []*http.Request {
+	t.Helper()
+	hits := upstream.Hits(path)
+	if len(hits) != want {
+		t.Fatalf("upstream got %d requests for %s, want %d", len(hits), path, want)
+	}
+	return hits
+}
+
+func TestManifestCacheCredentials(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2,"private":true}`)
+	front := newTestServer(t, "manifest_cache_entries: 100\nproxies:\n"+
+		proxyYAML("priv/", upstream.testUpstream, "org", `auth: "Basic cHJpdjpzZWNyZXQ="`, "manifest_ttl: 1h")+
+		proxyYAML("pub/", upstream.testUpstream, "org"))
+	digest, manifest := upstream.digest, upstream.manifest
+	_, privateToken := getToken(t, front, "scope=repository:priv/app:pull", "", "")
+	_, publicToken := getToken(t, front, "scope=repository:pub/app:pull", "", "")
+
+	getManifest(t, front, "/v2/priv/app/manifests/latest", privateToken, http.StatusOK, manifest)
+	getManifest(t, front, "/v2/priv/app/manifests/"+digest, privateToken, http.StatusOK, manifest)
+
+	// the anonymous proxy must ask upstream rather than be served what was
+	// fetched with the private proxy's credentials, by tag, by digest or
+	// as a stale manifest while upstream fails
+	for _, status := range []int{http.StatusNotFound, http.StatusServiceUnavailable} {
+		upstream.SetStatus(status)
+		for _, reference := range []string{"latest", digest} {
+			getManifest(t, front, "/v2/pub/app/manifests/"+reference, publicToken, status, nil)
+		}
+	}
+	if requests := upstream.Requests("/v2/org/app/manifests/latest"); len(requests) != 3 {
+		t.Errorf("upstream got %d requests for the tag, want 3", len(requests))
+	}
+
+	// the private proxy is still served from the cache
+	getManifest(t, front, "/v2/priv/app/manifests/latest", privateToken, http.StatusOK, manifest)
+	getManifest(t, front, "/v2/priv/app/manifests/"+digest, privateToken, http.StatusOK, manifest)
+}
+
+func TestManifestRoundTripTTL(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2}`)
+	front := newTestServer(t, "manifest_cache_entries: 100\nproxies:\n"+
+		proxyYAML("a/", upstream.testUpstream, "org", "manifest_ttl: 100ms"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	path := "/v2/org/app/manifests/latest"
+	first := upstream.manifest
+
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, first)
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, first)
+	checkHits(t, upstream, path, 1)
+
+	// once the TTL has passed the manifest is revalidated, and a 304 makes
+	// it fresh again
+	time.Sleep(150 * time.Millisecond)
+	resp := getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, first)
+	if digest := resp.Header.Get("Docker-Content-Digest"); digest != upstream.digest {
+		t.Errorf("revalidated manifest has digest %q, want %q", digest, upstream.digest)
+	}
+	hits := checkHits(t, upstream, path, 2)
+	if etag := hits[1].Header.Get("If-None-Match"); etag != fmt.Sprintf(`"%s"`, upstream.digest) {
+		t.Errorf("revalidation sent If-None-Match %q", etag)
+	}
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, first)
+	checkHits(t, upstream, path, 2)
+
+	// a changed tag replaces the cached manifest
+	upstream.SetManifest(`{"schemaVersion":2,"changed":true}`)
+	time.Sleep(150 * time.Millisecond)
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+	checkHits(t, upstream, path, 3)
+}
+
+func TestManifestRoundTripDigestHeader(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2}`)
+	upstream.ignoreETag = true
+	front := newTestServer(t, "manifest_cache_entries: 100\nproxies:\n"+
+		proxyYAML("a/", upstream.testUpstream, "org", "manifest_ttl: 100ms"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	path := "/v2/org/app/manifests/latest"
+
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+	time.Sleep(150 * time.Millisecond)
+
+	// upstream ignores If-None-Match, but the Docker-Content-Digest of its
+	// answer shows the manifest is unchanged so it's fresh again
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+	checkHits(t, upstream, path, 2)
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+	checkHits(t, upstream, path, 2)
+}
+
+func TestManifestRoundTripByDigest(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2}`)
+	front := newTestServer(t, "manifest_cache_entries: 100\nproxies:\n"+
+		proxyYAML("a/", upstream.testUpstream, "org"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	digest := upstream.digest
+
+	// without a TTL tags are revalidated on every request, but manifests
+	// requested by digest are never revalidated
+	for i := 1; i <= 3; i++ {
+		getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+		getManifest(t, front, "/v2/a/app/manifests/"+digest, token, http.StatusOK, upstream.manifest)
+		checkHits(t, upstream, "/v2/org/app/manifests/latest", i)
+		checkHits(t, upstream, "/v2/org/app/manifests/"+digest, 1)
+	}
+}
+
+func TestManifestRoundTripStaleIfError(t *testing.T) {
+	upstream := newTestManifestUpstream(t, `{"schemaVersion":2}`)
+	front := newTestServer(t, "manifest_cache_entries: 100\nproxies:\n"+
+		proxyYAML("a/", upstream.testUpstream, "org"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+
+	stale := func(name string) {
+		t.Helper()
+		resp := getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusOK, upstream.manifest)
+		if warning := resp.Header.Get("Warning"); warning != `110 - "Response is Stale"` {
+			t.Errorf("%s: stale manifest served with Warning %q", name, warning)
+		}
+	}
+	for _, status := range []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusServiceUnavailable} {
+		upstream.SetStatus(status)
+		stale(http.StatusText(status))
+	}
+
+	// other errors are passed on
+	upstream.SetStatus(http.StatusNotFound)
+	getManifest(t, front, "/v2/a/app/manifests/latest", token, http.StatusNotFound, nil)
+
+	upstream.Close()
+	stale("unreachable upstream")
+}
+
+func TestManifestCacheKey(t *testing.T) {
+	base := ManifestCacheKey("https://registry.local:5000", "/v2/org/app/manifests/latest", "latest", testManifestType, "")
+	for name, key := range map[string]string{
+		"plain-HTTP upstream": ManifestCacheKey("http://registry.local:5000", "/v2/org/app/manifests/latest", "latest", testManifestType, ""),
+		"other credentials":   ManifestCacheKey("https://registry.local:5000", "/v2/org/app/manifests/latest", "latest", testManifestType, "Basic cHJveHk6c2VjcmV0"),
+		"other media types":   ManifestCacheKey("https://registry.local:5000", "/v2/org/app/manifests/latest", "latest", "application/json", ""),
+	} {
+		if key == base {
+			t.Errorf("%s: same cache key", name)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryproxy_requests_total",
+		Help: "Requests handled, by proxy, endpoint kind and response status.",
+	}, []string{"proxy", "endpoint", "status"})
+
+	metricResponseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryproxy_response_bytes_total",
+		Help: "Response body bytes streamed to clients, by proxy.",
+	}, []string{"proxy"})
+
+	metricUpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "registryproxy_upstream_request_duration_seconds",
+		Help:    "Time until the response headers were received from upstream, by registry and endpoint kind.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"registry", "endpoint"})
+
+	metricTokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryproxy_tokens_total",
+		Help: "Tokens requested from the token endpoint, by proxy and result (issued or rejected, login_issued or login_rejected for logins without a scope).",
+	}, []string{"proxy", "result"})
+
+	metricDiscoveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "registryproxy_discovery_failures_total",
+		Help: "Failed attempts to discover the token endpoint of an upstream registry.",
+	}, []string{"registry"})
+
+	metricTokenCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "registryproxy_token_cache_hits_total",
+		Help: "Token requests answered with a cached upstream token.",
+	})
+
+	metricTokenCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "registryproxy_token_cache_misses_total",
+		Help: "Token requests which needed a request to the upstream token service.",
+	})
+
+	metricTokenCacheEvictions = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "registryproxy_token_cache_evictions_total",
+		Help: "Cached upstream tokens dropped because they were about to expire.",
+	})
+)
+
+// EndpointKind returns the kind of registry endpoint the given request path
+// refers to, for use as a metric label
+func EndpointKind(path string) string {
+	_, kind, _ := RepositoryFromPath(path)
+	switch kind {
+	case "manifests":
+		return "manifest"
+	case "blobs":
+		return "blob"
+	case "":
+		return "other"
+	default:
+		return kind
+	}
+}
+
+// RecordResponse counts the response (or error) returned from a RoundTrip
+// function, and arranges for the bytes of its body to be counted as they're
+// streamed to the client
+func RecordResponse(proxy, endpoint string, resp *http.Response, err error) {
+	if err != nil || resp == nil {
+		// errors are answered by ErrorHandler
+		metricRequests.WithLabelValues(proxy, endpoint, strconv.Itoa(ErrorFor(err).Status)).Inc()
+		return
+	}
+	metricRequests.WithLabelValues(proxy, endpoint, strconv.Itoa(resp.StatusCode)).Inc()
+	if resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &countingReadCloser{ReadCloser: resp.Body, counter: metricResponseBytes.WithLabelValues(proxy)}
+	}
+}
+
+// countingReadCloser adds the number of bytes read through it to a counter
+type countingReadCloser struct {
+	io.ReadCloser
+	counter prometheus.Counter
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.counter.Add(float64(n))
+	return n, err
+}
+
+// NewMetricsServer returns the HTTP server for the prometheus metrics, which
+// are served on a separate listener
+func NewMetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// ServeMetrics serves the prometheus metrics until the server is shut down
+func ServeMetrics(server *http.Server) {
+	logger.Info("serving metrics", "addr", server.Addr, "path", "/metrics")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("unable to start metrics listener", "error", err)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRecordResponseStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   *http.Response
+		err    error
+		status string
+	}{
+		{"response", &http.Response{StatusCode: http.StatusNotFound, Body: http.NoBody}, nil, "404"},
+		{"registry error", nil, fmt.Errorf("wrapped: %w", NewRegistryError(http.StatusTooManyRequests, errCodeTooMany, "slow down")), "429"},
+		{"timeout", nil, context.DeadlineExceeded, "503"},
+		{"other error", nil, errors.New("boom"), "502"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := metricRequests.WithLabelValues("metrics-test/", tt.name, tt.status)
+			before := testutil.ToFloat64(counter)
+			RecordResponse("metrics-test/", tt.name, tt.resp, tt.err)
+			if after := testutil.ToFloat64(counter); after != before+1 {
+				t.Errorf("requests with status %s went from %v to %v", tt.status, before, after)
+			}
+		})
+	}
+}
+
+// requests the router can't hand to a proxy are counted for the proxy ""
+func TestRouterNotFoundMetrics(t *testing.T) {
+	front := newTestServer(t, "proxies:\n  \"a/\":\n    registry: https://registry.example.com\n    remote: org\n")
+	tests := []struct {
+		path     string
+		endpoint string
+	}{
+		{"/v2/elsewhere/app/manifests/latest", "manifest"},
+		{"/v2/a/app/unsupported", "other"},
+	}
+	for _, tt := range tests {
+		counter := metricRequests.WithLabelValues("", tt.endpoint, "404")
+		before := testutil.ToFloat64(counter)
+		if resp := doRequest(t, front, http.MethodGet, tt.path, ""); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("GET %s: status %d, want %d", tt.path, resp.StatusCode, http.StatusNotFound)
+		}
+		if after := testutil.ToFloat64(counter); after != before+1 {
+			t.Errorf("GET %s: 404s for endpoint %s went from %v to %v", tt.path, tt.endpoint, before, after)
+		}
+	}
+}
+
+// logins without a scope aren't for any proxy, so they must not be counted
+// as tokens issued or rejected for the proxy ""
+func TestTokenMetricsLogin(t *testing.T) {
+	htpasswd := writeTestFile(t, "htpasswd", htpasswdLine(t, "alice", "alice-secret"))
+	front := newTestServer(t, "htpasswd: "+htpasswd+"\n")
+	counters := map[string]prometheus.Counter{}
+	before := map[string]float64{}
+	for _, result := range []string{"issued", "rejected", "login_issued", "login_rejected"} {
+		counters[result] = metricTokens.WithLabelValues("", result)
+		before[result] = testutil.ToFloat64(counters[result])
+	}
+
+	if status, _ := getToken(t, front, "", "alice", "alice-secret"); status != http.StatusOK {
+		t.Fatalf("login: status %d", status)
+	}
+	if status, _ := getToken(t, front, "", "alice", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("login with a wrong password: status %d", status)
+	}
+	for result, want := range map[string]float64{"issued": 0, "rejected": 0, "login_issued": 1, "login_rejected": 1} {
+		if got := testutil.ToFloat64(counters[result]) - before[result]; got != want {
+			t.Errorf("tokens %s for proxy \"\" went up by %v, want %v", result, got, want)
+		}
+	}
+}
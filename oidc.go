@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	jwksRefreshInterval    = time.Hour        // how often keys loaded from a URL are refreshed
+	jwksMinRefreshInterval = time.Minute      // minimum time between refreshes triggered by unknown key ids
+	jwksFetchTimeout       = 10 * time.Second // how long fetching keys from a URL may take
+	jwtValidationLeeway    = 30 * time.Second // allowed clock skew when validating exp/nbf/iat
+)
+
+// jwksClient fetches JWKS documents; authentication waits for it when a key
+// id is unknown, so it mustn't hang
+var jwksClient = &http.Client{Timeout: jwksFetchTimeout}
+
+// jwtSignatureAlgorithms are the JWT signature algorithms we accept
+var jwtSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// OIDCProvider is the configuration of an OIDC identity provider whose ID
+// tokens clients may exchange for tokens at the token endpoint
+type OIDCProvider struct {
+	Issuer   string `yaml:"issuer" json:"issuer"`       // expected "iss" claim
+	Audience string `yaml:"audience" json:"audience"`   // expected "aud" claim
+	JWKSFile string `yaml:"jwks_file" json:"jwks_file"` // path of a JWKS document with the issuer's keys
+	JWKSURL  string `yaml:"jwks_url" json:"jwks_url"`   // URL of a JWKS document with the issuer's keys
+}
+
+// OIDCVerifier validates ID tokens issued by a single OIDC provider
+type OIDCVerifier struct {
+	Provider OIDCProvider
+
+	mu          sync.Mutex
+	keys        jose.JSONWebKeySet
+	fetchedAt   time.Time // when keys were last loaded, or zero
+	attemptedAt time.Time // when loading keys was last attempted
+	group       singleflight.Group
+}
+
+// NewOIDCVerifier returns an OIDCVerifier for the given provider, its keys
+// are loaded immediately. Keys which can't be fetched from a URL are fetched
+// again when they're needed, so an unreachable provider only affects the
+// clients using it.
+func NewOIDCVerifier(provider OIDCProvider) (*OIDCVerifier, error) {
+	v := &OIDCVerifier{Provider: provider}
+	if err := v.refresh(); err != nil {
+		if provider.JWKSFile != "" {
+			return nil, err
+		}
+		tokenLogger.Warn("NewOIDCVerifier: unable to fetch keys, will retry when they're needed", "issuer", provider.Issuer, "error", err)
+	}
+	return v, nil
+}
+
+// refresh loads the keys and replaces the current ones; concurrent calls
+// share one attempt, and v.mu isn't held while the keys are loaded
+func (v *OIDCVerifier) refresh() error {
+	_, err, _ := v.group.Do("", func() (any, error) {
+		v.mu.Lock()
+		v.attemptedAt = time.Now()
+		v.mu.Unlock()
+
+		keys, err := v.loadKeys()
+		if err != nil {
+			return nil, err
+		}
+		v.mu.Lock()
+		v.keys = keys
+		v.fetchedAt = time.Now()
+		v.mu.Unlock()
+		return nil, nil
+	})
+	return err
+}
+
+// loadKeys reads the JWKS document from the configured file or URL
+func (v *OIDCVerifier) loadKeys() (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	var data []byte
+	var err error
+	if v.Provider.JWKSFile != "" {
+		tokenLogger.Debug("OIDCVerifier.loadKeys: reading JWKS file", "issuer", v.Provider.Issuer, "file", v.Provider.JWKSFile)
+		data, err = os.ReadFile(v.Provider.JWKSFile)
+		if err != nil {
+			return keys, fmt.Errorf("OIDCVerifier.loadKeys: unable to read JWKS file for %s; error: %w", v.Provider.Issuer, err)
+		}
+	} else {
+		tokenLogger.Debug("OIDCVerifier.loadKeys: fetching JWKS", "issuer", v.Provider.Issuer, "url", v.Provider.JWKSURL)
+		resp, err := jwksClient.Get(v.Provider.JWKSURL)
+		if err != nil {
+			return keys, fmt.Errorf("OIDCVerifier.loadKeys: unable to fetch JWKS for %s; error: %w", v.Provider.Issuer, err)
+		}
+		defer resp.Body.Close() //nolint
+		if resp.StatusCode != http.StatusOK {
+			return keys, fmt.Errorf("OIDCVerifier.loadKeys: unable to fetch JWKS for %s; status: %s", v.Provider.Issuer, resp.Status)
+		}
+		data, err = io.ReadAll(resp.Body)
+		if err != nil {
+			return keys, fmt.Errorf("OIDCVerifier.loadKeys: unable to read JWKS for %s; error: %w", v.Provider.Issuer, err)
+		}
+	}
+
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return keys, fmt.Errorf("OIDCVerifier.loadKeys: unable to parse JWKS for %s; error: %w", v.Provider.Issuer, err)
+	}
+	tokenLogger.Info("OIDCVerifier.loadKeys: loaded keys", "issuer", v.Provider.Issuer, "keys", len(keys.Keys))
+	return keys, nil
+}
+
+// lookupKeys returns the keys with the given key id. Keys loaded from a URL
+// are refreshed in the background once they're stale; if the key id is
+// unknown the keys are refreshed first, at most once per
+// jwksMinRefreshInterval.
+func (v *OIDCVerifier) lookupKeys(keyID string) []jose.JSONWebKey {
+	v.mu.Lock()
+	keys := v.keys.Key(keyID)
+	stale := time.Since(v.fetchedAt) > jwksRefreshInterval
+	retry := time.Since(v.attemptedAt) > jwksMinRefreshInterval
+	v.mu.Unlock()
+
+	switch {
+	case v.Provider.JWKSURL == "" || !retry:
+		return keys
+	case len(keys) > 0:
+		if stale {
+			go v.refreshLogged()
+		}
+		return keys
+	}
+	if err := v.refreshLogged(); err != nil {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.keys.Key(keyID)
+}
+
+// refreshLogged runs refresh and logs its failure
+func (v *OIDCVerifier) refreshLogged() error {
+	err := v.refresh()
+	if err != nil {
+		tokenLogger.Warn("OIDCVerifier.lookupKeys: unable to refresh keys", "issuer", v.Provider.Issuer, "error", err)
+	}
+	return err
+}
+
+// Verify checks the signature, issuer, audience and validity period of the
+// given token and returns its claims
+func (v *OIDCVerifier) Verify(token *jwt.JSONWebToken) (map[string]any, error) {
+	if len(token.Headers) == 0 {
+		return nil, fmt.Errorf("OIDCVerifier.Verify: token has no headers")
+	}
+	keys := v.lookupKeys(token.Headers[0].KeyID)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("OIDCVerifier.Verify: no key found for key id \"%s\"", token.Headers[0].KeyID)
+	}
+
+	for _, key := range keys {
+		var standardClaims jwt.Claims
+		var allClaims map[string]any
+		if err := token.Claims(key.Key, &standardClaims, &allClaims); err != nil {
+			continue
+		}
+		expected := jwt.Expected{
+			Issuer:      v.Provider.Issuer,
+			AnyAudience: jwt.Audience{v.Provider.Audience},
+			Time:        time.Now(),
+		}
+		if err := standardClaims.ValidateWithLeeway(expected, jwtValidationLeeway); err != nil {
+			return nil, fmt.Errorf("OIDCVerifier.Verify: invalid claims; error: %w", err)
+		}
+		if standardClaims.Expiry == nil {
+			// ValidateWithLeeway accepts tokens which never expire
+			return nil, fmt.Errorf("OIDCVerifier.Verify: token has no exp claim")
+		}
+		return allClaims, nil
+	}
+	return nil, fmt.Errorf("OIDCVerifier.Verify: signature verification failed")
+}
+
+// LooksLikeJWT returns true if the given string has the shape of a compact
+// serialized JWT (three dot-separated base64url segments)
+func LooksLikeJWT(s string) bool {
+	return strings.Count(s, ".") == 2 && !strings.HasPrefix(s, "v4.")
+}
+
+// ClaimRule is a set of claim patterns which must all match a token's claims;
+// patterns use path.Match syntax, e.g. {"repository": "org/*"}. The "iss"
+// entry is the issuer the rule applies to, see WithDefaultIssuer.
+type ClaimRule map[string]string
+
+// Issuer returns the issuer of the tokens the rule applies to
+func (rule ClaimRule) Issuer() string {
+	return rule["iss"]
+}
+
+// Matches returns true if every pattern in the rule matches the
+// corresponding claim
+func (rule ClaimRule) Matches(claims map[string]any) bool {
+	for name, pattern := range rule {
+		value, ok := claims[name]
+		if !ok {
+			return false
+		}
+		var valueString string
+		switch value := value.(type) {
+		case string:
+			valueString = value
+		default:
+			valueString = fmt.Sprint(value)
+		}
+		if matched, err := path.Match(pattern, valueString); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const (
+	testIssuer      = "https://issuer.example.com"
+	testOtherIssuer = "https://other.example.com"
+	testAudience    = "reg.example.com"
+)
+
+// newTestKey returns a new signing key with the given key id
+func newTestKey(t *testing.T, keyID string) jose.JSONWebKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose.JSONWebKey{Key: key, KeyID: keyID, Algorithm: string(jose.ES256), Use: "sig"}
+}
+
+// writeTestJWKS writes the public parts of the keys into a JWKS file
+func writeTestJWKS(t *testing.T, keys ...jose.JSONWebKey) string {
+	t.Helper()
+	jwks := jose.JSONWebKeySet{}
+	for _, key := range keys {
+		jwks.Keys = append(jwks.Keys, key.Public())
+	}
+	data, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writeTestFile(t, "jwks.json", string(data))
+}
+
+// signTestJWT returns a compact serialized JWT with the given claims
+func signTestJWT(t *testing.T, key jose.JSONWebKey, claims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.ES256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// testClaims returns valid claims from testIssuer, with the given overrides;
+// nil values remove the claim
+func testClaims(overrides map[string]any) map[string]any {
+	claims := map[string]any{
+		"iss":        testIssuer,
+		"aud":        testAudience,
+		"sub":        "repo:example-org/app:ref:refs/heads/main",
+		"exp":        time.Now().Add(5 * time.Minute).Unix(),
+		"iat":        time.Now().Unix(),
+		"repository": "example-org/app",
+		"ref":        "refs/heads/main",
+	}
+	for name, value := range overrides {
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+func TestOIDCVerifierVerify(t *testing.T) {
+	key := newTestKey(t, "k1")
+	verifier, err := NewOIDCVerifier(OIDCProvider{Issuer: testIssuer, Audience: testAudience, JWKSFile: writeTestJWKS(t, key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    jose.JSONWebKey
+		claims map[string]any
+		valid  bool
+	}{
+		{"good signature", key, testClaims(nil), true},
+		{"audience in a list", key, testClaims(map[string]any{"aud": []string{"other", testAudience}}), true},
+		{"wrong key", newTestKey(t, "k1"), testClaims(nil), false},
+		{"unknown kid", newTestKey(t, "k2"), testClaims(nil), false},
+		{"wrong iss", key, testClaims(map[string]any{"iss": testOtherIssuer}), false},
+		{"wrong aud", key, testClaims(map[string]any{"aud": "other.example.com"}), false},
+		{"expired", key, testClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()}), false},
+		{"expired within leeway", key, testClaims(map[string]any{"exp": time.Now().Add(-jwtValidationLeeway / 2).Unix()}), true},
+		{"not yet valid", key, testClaims(map[string]any{"nbf": time.Now().Add(time.Hour).Unix()}), false},
+		{"no exp", key, testClaims(map[string]any{"exp": nil}), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := jwt.ParseSigned(signTestJWT(t, tt.key, tt.claims), jwtSignatureAlgorithms)
+			if err != nil {
+				t.Fatal(err)
+			}
+			claims, err := verifier.Verify(token)
+			if tt.valid && (err != nil || claims["repository"] != "example-org/app") {
+				t.Errorf("got claims %v, error %v; want the token's claims", claims, err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("token was accepted")
+			}
+		})
+	}
+}
+
+func TestAuthenticatorAuthenticateJWT(t *testing.T) {
+	key, otherKey := newTestKey(t, "k1"), newTestKey(t, "k1")
+	config, err := loadTestConfig(t, `
+oidc:
+  - issuer: `+testIssuer+`
+    audience: `+testAudience+`
+    jwks_file: `+writeTestJWKS(t, key)+`
+  - issuer: `+testOtherIssuer+`
+    audience: `+testAudience+`
+    jwks_file: `+writeTestJWKS(t, otherKey)+`
+proxies:
+  "internal/":
+    registry: ghcr.io
+    claims:
+      - iss: `+testIssuer+`
+        repository: example-org/*
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuthenticator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := config.Proxies["internal/"]
+
+	tests := []struct {
+		name       string
+		token      string
+		identity   string // empty if authentication must fail
+		authorized bool
+	}{
+		{"good token", signTestJWT(t, key, testClaims(nil)), "repo:example-org/app:ref:refs/heads/main@" + testIssuer, true},
+		{"claims don't match", signTestJWT(t, key, testClaims(map[string]any{"repository": "evil-org/app"})), "repo:example-org/app:ref:refs/heads/main@" + testIssuer, false},
+		{"same claims from another issuer", signTestJWT(t, otherKey, testClaims(map[string]any{"iss": testOtherIssuer})), "repo:example-org/app:ref:refs/heads/main@" + testOtherIssuer, false},
+		{"signed by another issuer's key", signTestJWT(t, otherKey, testClaims(nil)), "", false},
+		{"unknown issuer", signTestJWT(t, key, testClaims(map[string]any{"iss": "https://unknown.example.com"})), "", false},
+		{"expired", signTestJWT(t, key, testClaims(map[string]any{"exp": time.Now().Add(-time.Hour).Unix()})), "", false},
+		{"not a JWT", "a.b.c", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := auth.authenticateJWT(tt.token)
+			if tt.identity == "" {
+				if err == nil {
+					t.Errorf("authenticated as %s", identity)
+				}
+				return
+			}
+			if err != nil || identity.String() != tt.identity {
+				t.Fatalf("authenticated as %q (error %v), want %s", identity.String(), err, tt.identity)
+			}
+			if authorized := auth.Authorized(identity, proxy); authorized != tt.authorized {
+				t.Errorf("authorized %v, want %v", authorized, tt.authorized)
+			}
+		})
+	}
+}
+
+func TestClaimRuleMatches(t *testing.T) {
+	claims := map[string]any{
+		"iss":        testIssuer,
+		"repository": "example-org/app",
+		"ref":        "refs/heads/main",
+		"run_number": float64(42),
+		"protected":  true,
+	}
+	tests := []struct {
+		name string
+		rule ClaimRule
+		want bool
+	}{
+		{"exact match", ClaimRule{"repository": "example-org/app"}, true},
+		{"all patterns match", ClaimRule{"repository": "example-org/*", "ref": "refs/heads/*"}, true},
+		{"one pattern doesn't match", ClaimRule{"repository": "example-org/*", "ref": "refs/tags/*"}, false},
+		{"glob doesn't cross slashes", ClaimRule{"repository": "*"}, false},
+		{"missing claim", ClaimRule{"environment": "*"}, false},
+		{"non-string claims", ClaimRule{"run_number": "42", "protected": "true"}, true},
+		{"bad pattern", ClaimRule{"repository": "["}, false},
+		{"issuer", ClaimRule{"iss": testIssuer, "repository": "example-org/app"}, true},
+		{"other issuer", ClaimRule{"iss": testOtherIssuer, "repository": "example-org/app"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Matches(claims); got != tt.want {
+				t.Errorf("Matches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClaimRuleIssuerConfig(t *testing.T) {
+	jwks := writeTestJWKS(t, newTestKey(t, "k1"))
+	provider := func(issuer string) string {
+		return "  - issuer: " + issuer + "\n    audience: " + testAudience + "\n    jwks_file: " + jwks + "\n"
+	}
+	proxy := func(rule string) string {
+		return "proxies:\n  \"internal/\":\n    registry: ghcr.io\n    claims:\n      - " + rule + "\n"
+	}
+	tests := []struct {
+		name   string
+		config string
+		issuer string // the rule's issuer after loading; empty if loading must fail
+	}{
+		{"single provider, iss left out", "oidc:\n" + provider(testIssuer) + proxy("repository: example-org/app"), testIssuer},
+		{"single provider, iss set", "oidc:\n" + provider(testIssuer) + proxy("iss: "+testIssuer), testIssuer},
+		{"several providers, iss set", "oidc:\n" + provider(testIssuer) + provider(testOtherIssuer) + proxy("iss: "+testOtherIssuer), testOtherIssuer},
+		{"several providers, iss left out", "oidc:\n" + provider(testIssuer) + provider(testOtherIssuer) + proxy("repository: example-org/app"), ""},
+		{"unknown iss", "oidc:\n" + provider(testIssuer) + proxy("iss: https://unknown.example.com"), ""},
+		{"glob iss", "oidc:\n" + provider(testIssuer) + proxy("iss: https://*"), ""},
+		{"empty rule", "oidc:\n" + provider(testIssuer) + proxy("{}"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := loadTestConfig(t, tt.config)
+			if tt.issuer == "" {
+				if err == nil {
+					t.Errorf("config was accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issuer := config.Proxies["internal/"].Claims[0].Issuer(); issuer != tt.issuer {
+				t.Errorf("rule issuer %q, want %s", issuer, tt.issuer)
+			}
+		})
+	}
+}
+
+// setTimes pretends the verifier fetched and attempted to fetch its keys at
+// the given times
+func setTimes(v *OIDCVerifier, fetchedAt, attemptedAt time.Time) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetchedAt, v.attemptedAt = fetchedAt, attemptedAt
+}
+
+func TestOIDCVerifierJWKSURL(t *testing.T) {
+	key := newTestKey(t, "k1")
+	jwks, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	status := http.StatusInternalServerError
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current := status
+		mu.Unlock()
+		if current == 0 {
+			<-hang
+			return
+		}
+		w.WriteHeader(current)
+		w.Write(jwks) //nolint
+	}))
+	defer server.Close()
+	defer close(hang)
+	setStatus := func(s int) {
+		mu.Lock()
+		status = s
+		mu.Unlock()
+	}
+	previousTimeout := jwksClient.Timeout
+	jwksClient.Timeout = 200 * time.Millisecond
+	defer func() { jwksClient.Timeout = previousTimeout }()
+
+	verify := func(v *OIDCVerifier, raw string) error {
+		t.Helper()
+		token, err := jwt.ParseSigned(raw, jwtSignatureAlgorithms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = v.Verify(token)
+		return err
+	}
+	good := signTestJWT(t, key, testClaims(nil))
+
+	// an unreachable JWKS URL doesn't stop the verifier from being created
+	verifier, err := NewOIDCVerifier(OIDCProvider{Issuer: testIssuer, Audience: testAudience, JWKSURL: server.URL})
+	if err != nil {
+		t.Fatalf("NewOIDCVerifier: %v", err)
+	}
+	if err := verify(verifier, good); err == nil {
+		t.Fatal("token was accepted without keys")
+	}
+
+	// the keys are fetched once the provider recovers and the retry is due
+	setStatus(http.StatusOK)
+	if err := verify(verifier, good); err == nil {
+		t.Fatal("keys were fetched again before jwksMinRefreshInterval")
+	}
+	setTimes(verifier, time.Time{}, time.Now().Add(-2*jwksMinRefreshInterval))
+	if err := verify(verifier, good); err != nil {
+		t.Fatalf("token was refused after the provider recovered: %v", err)
+	}
+
+	// stale keys are refreshed in the background, a hanging provider
+	// doesn't hold up tokens signed with known keys
+	setStatus(0)
+	setTimes(verifier, time.Now().Add(-2*jwksRefreshInterval), time.Now().Add(-2*jwksRefreshInterval))
+	start := time.Now()
+	if err := verify(verifier, good); err != nil || time.Since(start) > jwksClient.Timeout/2 {
+		t.Errorf("verification with a known key took %s, error %v", time.Since(start), err)
+	}
+
+	// unknown keys wait for the provider, but only until the fetch times out
+	setTimes(verifier, time.Now(), time.Now().Add(-2*jwksMinRefreshInterval))
+	start = time.Now()
+	if err := verify(verifier, signTestJWT(t, newTestKey(t, "k2"), testClaims(nil))); err == nil || time.Since(start) > 5*jwksClient.Timeout {
+		t.Errorf("verification with an unknown key took %s, error %v", time.Since(start), err)
+	}
+}
+
+func TestNewServerWithUnreachableJWKS(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	config, err := loadTestConfig(t, "oidc:\n  - issuer: "+testIssuer+"\n    audience: "+testAudience+"\n    jwks_url: "+server.URL+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer("", config); err != nil {
+		t.Errorf("NewServer: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces secrets which are never useful in logs, like the secret key
+const redacted = "REDACTED"
+
+// sensitiveHeaders are the headers whose values are redacted when requests
+// and responses are logged
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// tokenFieldRegex matches the token fields of token endpoint response bodies
+// (see https://distribution.github.io/distribution/spec/auth/token/); the
+// closing quote is optional so tokens in truncated bodies are matched too
+var tokenFieldRegex = regexp.MustCompile(`("(?:token|access_token|refresh_token|id_token)"\s*:\s*")([^"]*)("?)`)
+
+// Fingerprint returns a short hash of the given secret, so log lines
+// mentioning the same token can be correlated without revealing it; only
+// use it for high-entropy secrets, the hash of a password can be reversed by
+// guessing
+func Fingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// RedactCredentials masks the credentials in an Authorization header value,
+// keeping the scheme: bearer tokens are replaced with their fingerprint, e.g.
+// "Bearer sha256:1a2b3c4d5e6f", anything else (like the password in Basic
+// credentials) with "REDACTED"
+func RedactCredentials(value string) string {
+	scheme, credentials, ok := strings.Cut(value, " ")
+	if !ok {
+		return redacted
+	}
+	if strings.EqualFold(scheme, "Bearer") {
+		return scheme + " " + Fingerprint(credentials)
+	}
+	return scheme + " " + redacted
+}
+
+// RedactHeaders returns a copy of the given headers with the values of
+// sensitive headers redacted, see RedactCredentials
+func RedactHeaders(header http.Header) http.Header {
+	clean := header.Clone()
+	for _, name := range sensitiveHeaders {
+		for i, value := range clean[name] {
+			clean[name][i] = RedactCredentials(value)
+		}
+	}
+	return clean
+}
+
+// RedactBody replaces the tokens in a (JSON) token response body with their
+// fingerprints
+func RedactBody(body []byte) []byte {
+	return tokenFieldRegex.ReplaceAllFunc(body, func(match []byte) []byte {
+		parts := tokenFieldRegex.FindSubmatch(match)
+		return []byte(string(parts[1]) + Fingerprint(string(parts[2])) + string(parts[3]))
+	})
+}
+
+// Redacted returns a copy of the configuration with the secret key and the
+// upstream credentials masked, suitable for printing
+func (cfg Config) Redacted() Config {
+	if cfg.SecretKey != "" {
+		cfg.SecretKey = redacted
+	}
+	proxies := make(map[string]ProxyItem, len(cfg.Proxies))
+	for name, proxy := range cfg.Proxies {
+		if proxy.AuthHeader != "" {
+			proxy.AuthHeader = RedactCredentials(proxy.AuthHeader)
+		}
+		proxies[name] = proxy
+	}
+	cfg.Proxies = proxies
+	cfg.routes = nil
+	return cfg
+}
+
+// LogValue implements slog.LogValuer so token responses can be logged
+// without revealing the token
+func (tr TokenResponse) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("token", Fingerprint(tr.Token)),
+		slog.Uint64("expires_in", uint64(tr.ExpiresIn)),
+		slog.Time("issued_at", tr.IssuedAt),
+		slog.String("error", tr.Error),
+	)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedactCredentials(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Bearer upstream-token", "Bearer " + Fingerprint("upstream-token")},
+		{"bearer upstream-token", "bearer " + Fingerprint("upstream-token")},
+		{"Basic YWxpY2U6c2VjcmV0", "Basic REDACTED"},
+		{"basic YWxpY2U6c2VjcmV0", "basic REDACTED"},
+		{"Negotiate abcdef", "Negotiate REDACTED"},
+		{"session=abcdef", "REDACTED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if got := RedactCredentials(tt.value); got != tt.want {
+				t.Errorf("RedactCredentials(%q) = %q, want %q", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	header := http.Header{
+		"Authorization": {"Basic YWxpY2U6c2VjcmV0"},
+		"Cookie":        {"session=abcdef"},
+		"Accept":        {"application/json"},
+	}
+	clean := RedactHeaders(header)
+	if clean.Get("Authorization") != "Basic REDACTED" || clean.Get("Cookie") != "REDACTED" || clean.Get("Accept") != "application/json" {
+		t.Errorf("RedactHeaders() = %v", clean)
+	}
+	if header.Get("Authorization") != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("RedactHeaders modified the original headers")
+	}
+}
+
+func TestConfigRedacted(t *testing.T) {
+	config := Config{
+		SecretKey: testSecretKey,
+		Proxies: map[string]ProxyItem{
+			"basic/":  {AuthHeader: "Basic YWxpY2U6c2VjcmV0"},
+			"bearer/": {AuthHeader: "Bearer static-token"},
+			"none/":   {},
+		},
+	}
+	clean := config.Redacted()
+	if clean.SecretKey != redacted {
+		t.Errorf("secret key is %q", clean.SecretKey)
+	}
+	if auth := clean.Proxies["basic/"].AuthHeader; auth != "Basic REDACTED" || strings.Contains(auth, "sha256:") {
+		t.Errorf("basic auth is %q", auth)
+	}
+	if auth := clean.Proxies["bearer/"].AuthHeader; auth != "Bearer "+Fingerprint("static-token") {
+		t.Errorf("bearer auth is %q", auth)
+	}
+	if auth := clean.Proxies["none/"].AuthHeader; auth != "" {
+		t.Errorf("empty auth is %q", auth)
+	}
+	if config.Proxies["basic/"].AuthHeader != "Basic YWxpY2U6c2VjcmV0" {
+		t.Errorf("Redacted modified the original config")
+	}
+}
@@ -4,38 +4,65 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httputil"
+	"regexp"
+	"slices"
 	"strings"
+	"time"
 
 	"aidanwoods.dev/go-paseto"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var repositoryPathRegex = regexp.MustCompile(`^/v2/(?P<name>.+)/(?P<kind>manifests|blobs|tags|referrers)/(?P<reference>.*)$`)
+
+// blobRedirectHeaderTimeout is how long a CDN may take to start answering a
+// followed blob redirect; the blob itself may take as long as it needs
+const blobRedirectHeaderTimeout = 30 * time.Second
+
+// blobRedirectTransport is used to follow blob redirects to CDNs, so a
+// stalled CDN can't hold the request and its cache writer indefinitely
+var blobRedirectTransport = func() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = blobRedirectHeaderTimeout
+	return transport
+}()
+
+var blobRedirectClient = &http.Client{Transport: blobRedirectTransport}
+
 type RegistryProxy struct {
 	Config    ProxyItem
 	SecretKey paseto.V4SymmetricKey
 	FQDN      string
+	Blobs     *BlobCache     // nil if blob caching is disabled
+	Manifests *ManifestCache // nil if manifest caching is disabled
+	Endpoints *TokenEndpoints
 }
 
 // NewRegistryProxy returns a reverse proxy to the specified registry.
-func NewRegistryProxy(cfg ProxyItem, secretKey paseto.V4SymmetricKey, fqdn string) http.HandlerFunc {
+func NewRegistryProxy(cfg ProxyItem, secretKey paseto.V4SymmetricKey, fqdn string, blobs *BlobCache, manifests *ManifestCache, endpoints *TokenEndpoints) http.HandlerFunc {
 	rp := &RegistryProxy{
 		Config:    cfg,
 		SecretKey: secretKey,
 		FQDN:      fqdn,
+		Blobs:     blobs,
+		Manifests: manifests,
+		Endpoints: endpoints,
 	}
 	return (&httputil.ReverseProxy{
 		FlushInterval: -1,
 		Director:      rp.Director,
 		Transport:     rp,
+		ErrorHandler:  ErrorHandler(registryLogger),
 	}).ServeHTTP
 }
 
 // Director rewrites request.URL like /v2/* that come into the server
-// into https://[GCR_HOST]/v2/[PROJECT_ID]/*
+// into https://[GCR_HOST]/v2/[PROJECT_ID]/* (or http:// for plain-HTTP registries)
 func (rp *RegistryProxy) Director(req *http.Request) {
 	u := req.URL.String()
 	req.Host = rp.Config.RegistryHost
 	req.URL.Host = rp.Config.RegistryHost
-	req.URL.Scheme = "https"
+	req.URL.Scheme = rp.Config.Scheme
 
 	localPath := fmt.Sprintf("/v2/%s/", strings.Trim(rp.Config.LocalPrefix, "/"))
 	remotePath := fmt.Sprintf("/v2/%s/", strings.Trim(rp.Config.RemotePrefix, "/"))
@@ -46,8 +73,21 @@ func (rp *RegistryProxy) Director(req *http.Request) {
 		}
 	}
 
+	// cross-repository blob mounts name the repository to mount from in the
+	// query; only repositories of this proxy can be translated, for any other
+	// the upload falls back to a plain upload
+	if query := req.URL.Query(); query.Has("from") {
+		if remoteFrom, ok := rp.RemoteName(query.Get("from")); ok {
+			query.Set("from", remoteFrom)
+		} else {
+			query.Del("mount")
+			query.Del("from")
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+
 	req.RequestURI = "" // clearing this to avoid conflicts
-	logger.Debug("RegistryProxy.Director: rewrote url",
+	registryLogger.Debug("RegistryProxy.Director: rewrote url",
 		"from", u,
 		"to", req.URL.String())
 }
@@ -56,81 +96,418 @@ func (rp *RegistryProxy) Director(req *http.Request) {
 // requests then performs them, finally it returns the modified result to the
 // client
 func (rp *RegistryProxy) RoundTrip(req *http.Request) (*http.Response, error) {
-	logger.Debug("RegistryProxy.RoundTrip: request received", "url", req.URL)
+	endpoint := EndpointKind(req.URL.Path)
+	ctx, span := tracer.Start(req.Context(), "RegistryProxy.RoundTrip", trace.WithAttributes(
+		attrProxy.String(rp.Config.LocalPrefix),
+		attrUpstreamHost.String(rp.Config.RegistryHost),
+		attrEndpoint.String(endpoint),
+	))
+	entry := AccessLogEntryFrom(req.Context())
+	entry.Proxy = rp.Config.LocalPrefix
+	_, kind, reference := RepositoryFromPath(req.URL.Path)
+	if IsDigest(reference) {
+		span.SetAttributes(attrDigest.String(reference))
+	}
+	resp, err := rp.roundTrip(req.WithContext(ctx))
+	EndSpan(span, resp, err)
+	if kind == "manifests" || kind == "blobs" {
+		entry.Digest = reference
+		if !IsDigest(reference) && resp != nil {
+			entry.Digest = resp.Header.Get("Docker-Content-Digest")
+		}
+	}
+	RecordResponse(rp.Config.LocalPrefix, endpoint, resp, err)
+	return resp, err
+}
 
-	// Retrieve the proxy config context value
-	proxy := rp.Config
+func (rp *RegistryProxy) roundTrip(req *http.Request) (*http.Response, error) {
+	registryLogger.Debug("RegistryProxy.RoundTrip: request received", "url", req.URL)
+
+	// refuse methods which would require an action the proxy doesn't allow
+	action := RequiredAction(req.Method)
+	if action == "" {
+		registryLogger.Info("RegistryProxy.RoundTrip: rejected request with unsupported method", "url", req.URL, "method", req.Method)
+		return NewRegistryError(http.StatusMethodNotAllowed, errCodeUnsupported, fmt.Sprintf("method %s is not supported", req.Method)).Response(req), nil
+	}
+	if !rp.Config.Allows(action) {
+		registryLogger.Info("RegistryProxy.RoundTrip: rejected request for disallowed action", "url", req.URL, "method", req.Method, "action", action)
+		return NewRegistryError(http.StatusForbidden, errCodeDenied, fmt.Sprintf("%s access is not allowed through this proxy", action)).Response(req), nil
+	}
+
+	// the rewritten path must stay within the repositories of the proxy,
+	// otherwise its tokens and credentials would be used for others
+	if remoteName, _, _ := RepositoryFromPath(req.URL.Path); !rp.IsRemoteName(remoteName) {
+		registryLogger.Info("RegistryProxy.RoundTrip: rejected request outside the proxy's repositories", "url", req.URL, "repository", remoteName)
+		return NewRegistryError(http.StatusNotFound, errCodeNameUnknown, "repository name not known to registry").Response(req), nil
+	}
 
 	// replace the outgoing "Authorization: Bearer abcdeg..." header with one we embedded in the token
-	authHeader := req.Header.Get("Authorization")
-	if authHeader != "" {
-		logger.Debug("RegistryProxy.RoundTrip: have auth header", "header", authHeader)
-		if !strings.HasPrefix(authHeader, "Bearer ") {
-			return nil, fmt.Errorf("RegistryProxy.RoundTrip: Authorization header in unknown format: %s", authHeader)
-		}
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		parser := paseto.NewParserForValidNow()
-		token, err := parser.ParseV4Local(rp.SecretKey, tokenString, []byte{})
-		if err != nil {
-			return nil, fmt.Errorf("RegistryProxy.RoundTrip: unable to parse token from auth header; token:%s; error:%s", tokenString, err)
+	authorized := false
+	if req.Header.Get("Authorization") != "" {
+		upstreamToken, regErr := rp.Authorize(req)
+		if regErr != nil {
+			registryLogger.Info("RegistryProxy.RoundTrip: rejected request", "url", req.URL, "method", req.Method, "error", regErr)
+			return regErr.Response(req), nil
 		}
-
-		upstreamToken, err := token.GetString(tokenKeyUpstreamToken)
-		if err != nil {
-			logger.Debug("claims found in token", "claims", token.ClaimsJSON())
-			return nil, fmt.Errorf("RegistryProxy.RoundTrip: unable to parse upstreamToken string from token; error:%s", err)
+		if authorization := rp.UpstreamAuthorization(req, upstreamToken); authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		} else {
+			req.Header.Del("Authorization")
 		}
+		registryLogger.Debug("RegistryProxy.RoundTrip: set Authorization header", "header", RedactCredentials(req.Header.Get("Authorization")))
+		authorized = true
+	} else if rp.Config.RequiresAuth() {
+		// anonymous requests would reach upstream with the proxy's own
+		// credentials, bypassing the proxy's access rules
+		registryLogger.Info("RegistryProxy.RoundTrip: rejected anonymous request", "url", req.URL, "method", req.Method)
+		return rp.Unauthorized(req, "").Response(req), nil
+	} else if _, err := rp.Endpoints.ForProxy(req.Context(), rp.Config); err != nil {
+		// clients without a token would be sent to a token endpoint we can't
+		// proxy to yet
+		registryLogger.Warn("RegistryProxy.RoundTrip: token endpoint of registry is unavailable", "registry", rp.Config.RegistryHost, "error", err)
+		return NewRegistryError(http.StatusServiceUnavailable, errCodeUnavailable, fmt.Sprintf("the token service of %s is unavailable", rp.Config.RegistryHost)).Response(req), nil
+	}
 
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", upstreamToken))
-		logger.Debug("RegistryProxy.RoundTrip: set Authorization header", "header", req.Header.Get("Authorization"))
+	// blobs are served from the cache without contacting upstream, but only
+	// to clients which hold a valid token for the repository
+	_, kind, reference := RepositoryFromPath(req.URL.Path)
+	cacheableBlob := rp.Blobs != nil && kind == "blobs" && rp.Blobs.Cacheable(reference) &&
+		(req.Method == http.MethodGet || req.Method == http.MethodHead)
+	if cacheableBlob && authorized {
+		if resp := rp.CachedBlobResponse(req, reference); resp != nil {
+			return resp, nil
+		}
 	}
 
 	SetUserAgent(req, rp.FQDN)
 	CleanHeaders(req)
 
-	LogRequest("RegistryProxy.RoundTrip: about to make the following request to upstream", req)
-
-	resp, err := http.DefaultTransport.RoundTrip(req)
-	LogResponse("RegistryProxy.RoundTrip: response from upstream", resp)
+	var resp *http.Response
+	var err error
+	if rp.Manifests != nil && authorized && kind == "manifests" && (req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		resp, err = rp.ManifestRoundTrip(req, reference)
+	} else {
+		resp, err = rp.Upstream(req)
+	}
 	if err != nil {
-		logger.Error("RegistryProxy.RoundTrip: upstream request failed", "error", err)
 		return nil, err
 	}
-	logger.Info("RegistryProxy.RoundTrip: upstream request completed", "status", resp.StatusCode, "url", req.URL)
+
+	if cacheableBlob && req.Method == http.MethodGet {
+		resp = rp.CacheBlobResponse(req, resp, reference)
+	}
 
 	// Google Artifact Registry sends a "location: /artifacts-downloads/..." URL
 	// to download blobs. We don't want these routed to the proxy itself.
 	if locHdr := resp.Header.Get("location"); req.Method == http.MethodGet &&
 		resp.StatusCode == http.StatusFound && strings.HasPrefix(locHdr, "/") {
-		logger.Info("RegistryProxy.RoundTrip: applying Google Artifact Registry location header")
+		registryLogger.Info("RegistryProxy.RoundTrip: applying Google Artifact Registry location header")
 		resp.Header.Set("location", req.URL.Scheme+"://"+req.URL.Host+locHdr)
 	}
 
+	// upstream repository names in headers and tags lists are translated
+	// back into our own
+	if resp, err = rp.RewriteResponse(req, resp); err != nil {
+		return nil, err
+	}
+
 	// If the response included a WWW-Authenticate header we replace it with
 	// our own adjusted header that points to our own token endpoint
 	// see: https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/WWW-Authenticate
 	// and: https://distribution.github.io/distribution/spec/auth/token/
-	if authHeader := resp.Header.Get("www-authenticate"); authHeader != "" {
-		logger.Debug("RegistryProxy.RoundTrip: have www-authenticate header", "header", authHeader)
-		authHeaderFields, ok := ParseWWWAuthenticate(authHeader)
+	if authHeaders := resp.Header.Values("www-authenticate"); len(authHeaders) > 0 {
+		registryLogger.Debug("RegistryProxy.RoundTrip: have www-authenticate header", "header", authHeaders)
+		authHeaderFields, ok := ParseWWWAuthenticate(authHeaders...)
 		if !ok {
-			return nil, fmt.Errorf("RegistryProxy.RoundTrip: parsing WWW-Authenticate header failed header: %s", authHeader)
+			return nil, fmt.Errorf("RegistryProxy.RoundTrip: parsing WWW-Authenticate header failed header: %s", strings.Join(authHeaders, ", "))
 		}
-		logger.Debug("RegistryProxy.RoundTrip: parsed www-authenticate header", "parsed", authHeaderFields)
+		registryLogger.Debug("RegistryProxy.RoundTrip: parsed www-authenticate header", "parsed", authHeaderFields)
 
+		if authHeaderFields.IsBasic() {
+			// the params of basic auth challenges don't apply to our tokens
+			authHeaderFields = WWWAuthenticateData{}
+		}
+		authHeaderFields.Scheme = "Bearer"
 		authHeaderFields.Realm = fmt.Sprintf(`https://%s/_token`, rp.FQDN)
 		authHeaderFields.Service = rp.FQDN
-		headerScope, err := ParseResourceScope(authHeaderFields.Scope)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse scope in www-authenticate header; error:%s", err)
+		if authHeaderFields.Scope != "" {
+			headerScopes, err := ParseScopes(authHeaderFields.Scope)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse scope in www-authenticate header; error:%s", err)
+			}
+			localScopes := []string{}
+			for _, headerScope := range headerScopes {
+				if headerScope.IsRepository() {
+					headerScope.ResourceName = rp.LocalName(headerScope.ResourceName)
+				}
+				localScopes = append(localScopes, headerScope.String())
+			}
+			authHeaderFields.Scope = strings.Join(localScopes, " ")
+		} else if name, _, _ := RepositoryFromPath(req.URL.Path); name != "" {
+			// basic auth challenges have no scope, clients need one to ask
+			// our token endpoint for a token
+			authHeaderFields.Scope = (&ResourceScope{ResourceType: "repository", ResourceName: rp.LocalName(name), ResourceActions: []string{RequiredAction(req.Method)}}).String()
 		}
-		headerScope.ResourceName = SlashJoin(proxy.LocalPrefix, strings.TrimPrefix(headerScope.ResourceName, proxy.RemotePrefix), true)
-		authHeaderFields.Scope = headerScope.String()
 
 		newAuthHeader := authHeaderFields.String()
 		resp.Header.Set("www-authenticate", newAuthHeader)
-		logger.Debug("RegistryProxy.RoundTrip: rewrote www-authenticate header", "from", authHeader, "to", newAuthHeader)
+		registryLogger.Debug("RegistryProxy.RoundTrip: rewrote www-authenticate header", "from", authHeaders, "to", newAuthHeader)
+	}
+
+	return resp, nil
+}
+
+// Authorize checks the PASETO token in the request's Authorization header
+// against the request; the token must have been issued for this proxy and
+// must grant the action implied by the request method on the repository in
+// the request path. On success the embedded upstream token is returned.
+func (rp *RegistryProxy) Authorize(req *http.Request) (string, *RegistryError) {
+	remoteName, _, _ := RepositoryFromPath(req.URL.Path)
+	localName := rp.LocalName(remoteName)
+	action := RequiredAction(req.Method)
+	unauthorized := rp.Unauthorized(req, "invalid_token")
+
+	token, err := ParseToken(rp.SecretKey, req.Header.Get("Authorization"))
+	if err != nil {
+		registryLogger.Debug("RegistryProxy.Authorize: unable to parse token from auth header", "error", err)
+		return "", unauthorized
+	}
+
+	upstreamToken, err := token.GetString(tokenKeyUpstreamToken)
+	if err != nil {
+		registryLogger.Debug("RegistryProxy.Authorize: unable to parse upstreamToken string from token", "error", err)
+		return "", unauthorized
+	}
+	if subject, err := token.GetSubject(); err == nil {
+		AccessLogEntryFrom(req.Context()).Identity = subject
+	}
+
+	// the token must have been issued for this proxy (among others) and registry
+	var tokenProxies []string
+	token.Get(tokenKeyProxies, &tokenProxies) //nolint
+	tokenRegistry, _ := token.GetString(tokenKeyRegistry)
+	if !slices.Contains(tokenProxies, rp.Config.LocalPrefix) || tokenRegistry != rp.Config.RegistryHost {
+		registryLogger.Debug("RegistryProxy.Authorize: token was issued for a different proxy",
+			"token_proxies", tokenProxies,
+			"token_registry", tokenRegistry,
+			"proxy", rp.Config.LocalPrefix,
+			"registry", rp.Config.RegistryHost)
+		return "", NewRegistryError(http.StatusForbidden, errCodeDenied, "token was not issued for this repository")
+	}
+
+	// the token must grant the required action on the requested repository
+	var scopes []string
+	if err := token.Get(tokenKeyScopes, &scopes); err != nil {
+		registryLogger.Debug("RegistryProxy.Authorize: unable to parse scopes from token", "error", err)
+		return "", unauthorized
+	}
+	if !ScopesGrant(scopes, localName, action) {
+		registryLogger.Debug("RegistryProxy.Authorize: token does not grant the requested access",
+			"repository", localName,
+			"action", action,
+			"scopes", scopes)
+		denied := NewRegistryError(http.StatusForbidden, errCodeDenied, fmt.Sprintf("requested access to %s is not granted by the token", localName))
+		denied.Challenge = rp.Challenge(req, "insufficient_scope").String()
+		return "", denied
+	}
+
+	// cross-repository blob mounts also read the repository mounted from,
+	// without pull access to it the upload falls back to a plain upload
+	if query := req.URL.Query(); query.Has("from") {
+		if fromName := rp.LocalName(query.Get("from")); !ScopesGrant(scopes, fromName, "pull") {
+			registryLogger.Debug("RegistryProxy.Authorize: token does not grant pull access to the mount source, dropping the mount",
+				"from", fromName,
+				"scopes", scopes)
+			query.Del("mount")
+			query.Del("from")
+			req.URL.RawQuery = query.Encode()
+		}
 	}
+	return upstreamToken, nil
+}
+
+// ScopesGrant returns true if one of the given token scopes grants the action
+// on the (local) repository name
+func ScopesGrant(scopes []string, name, action string) bool {
+	for _, scopeString := range scopes {
+		scope, err := ParseResourceScope(scopeString)
+		if err != nil {
+			continue
+		}
+		if scope.IsRepository() && scope.ResourceName == name && scope.HasAction(action) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpstreamAuthorization returns the Authorization header to send upstream
+// with the (already rewritten) request, given the upstream token embedded in
+// the client's token; tokens for registries using basic auth carry no
+// upstream token, the proxy's own credentials are sent instead, but only for
+// the repositories of the proxy
+func (rp *RegistryProxy) UpstreamAuthorization(req *http.Request, upstreamToken string) string {
+	if upstreamToken != "" {
+		return fmt.Sprintf("Bearer %s", upstreamToken)
+	}
+	if remoteName, _, _ := RepositoryFromPath(req.URL.Path); rp.Config.AuthHeader != "" && rp.IsRemoteName(remoteName) {
+		return rp.Config.AuthHeader
+	}
+	return ""
+}
+
+// Challenge returns the Bearer challenge pointing clients at our token
+// endpoint for the repository and action of the request; challengeError is
+// the "error" parameter, if any
+func (rp *RegistryProxy) Challenge(req *http.Request, challengeError string) WWWAuthenticateData {
+	challenge := WWWAuthenticateData{
+		Scheme:  "Bearer",
+		Realm:   fmt.Sprintf("https://%s/_token", rp.FQDN),
+		Service: rp.FQDN,
+		Error:   challengeError,
+	}
+	if remoteName, _, _ := RepositoryFromPath(req.URL.Path); remoteName != "" {
+		challenge.Scope = (&ResourceScope{ResourceType: "repository", ResourceName: rp.LocalName(remoteName), ResourceActions: []string{RequiredAction(req.Method)}}).String()
+	}
+	return challenge
+}
+
+// Unauthorized returns a 401 error carrying the challenge for the request
+func (rp *RegistryProxy) Unauthorized(req *http.Request, challengeError string) *RegistryError {
+	unauthorized := NewRegistryError(http.StatusUnauthorized, errCodeUnauthorized, "authentication required")
+	unauthorized.Challenge = rp.Challenge(req, challengeError).String()
+	return unauthorized
+}
+
+// LocalName translates the given upstream repository name into the name
+// that clients of this proxy use for it
+func (rp *RegistryProxy) LocalName(remoteName string) string {
+	return SlashJoin(rp.Config.LocalPrefix, strings.TrimPrefix(remoteName, rp.Config.RemotePrefix), true)
+}
+
+// RemoteName translates the name clients of this proxy use for a repository
+// into the upstream repository name; it returns false if the proxy doesn't
+// handle the name
+func (rp *RegistryProxy) RemoteName(localName string) (string, bool) {
+	if !rp.Config.Matches(localName) {
+		return "", false
+	}
+	return SlashJoin(rp.Config.RemotePrefix, strings.TrimPrefix(localName, rp.Config.LocalPrefix), true), true
+}
+
+// RepositoryFromPath splits a registry API path like
+// "/v2/library/nginx/manifests/latest" into the repository name
+// ("library/nginx"), the endpoint kind ("manifests") and the remainder of the
+// path ("latest"); empty strings are returned if the path doesn't match.
+// Repository names may contain components like "blobs", so as in the
+// distribution path grammar the path is split at the last endpoint kind.
+func RepositoryFromPath(path string) (name, kind, reference string) {
+	mm, matched := MatchMap(repositoryPathRegex, path)
+	if !matched {
+		return "", "", ""
+	}
+	return mm["name"], mm["kind"], mm["reference"]
+}
 
+// Upstream sends the request to the upstream registry
+func (rp *RegistryProxy) Upstream(req *http.Request) (*http.Response, error) {
+	ctx, span := tracer.Start(req.Context(), "RegistryProxy.Upstream", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrUpstreamHost.String(req.URL.Host)))
+	req = req.WithContext(ctx)
+	InjectTraceContext(req)
+	AccessLogEntryFrom(ctx).UpstreamURL = req.URL.String()
+	LogRequest(registryLogger, "RegistryProxy.Upstream: about to make the following request to upstream", req)
+
+	start := time.Now()
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	metricUpstreamDuration.WithLabelValues(rp.Config.RegistryHost, EndpointKind(req.URL.Path)).Observe(time.Since(start).Seconds())
+	EndSpan(span, resp, err)
+	LogResponse(registryLogger, "RegistryProxy.Upstream: response from upstream", resp)
+	if err != nil {
+		registryLogger.Error("RegistryProxy.Upstream: upstream request failed", "error", err)
+		return nil, err
+	}
+	registryLogger.Info("RegistryProxy.Upstream: upstream request completed", "status", resp.StatusCode, "url", req.URL)
 	return resp, nil
 }
+
+// BlobCacheRepoKey returns the key of the upstream repository in the
+// (already rewritten) request path, see BlobCache
+func (rp *RegistryProxy) BlobCacheRepoKey(req *http.Request) string {
+	remoteName, _, _ := RepositoryFromPath(req.URL.Path)
+	return BlobCacheRepoKey(rp.Config.RegistryURL(), remoteName, rp.Config.AuthHeader)
+}
+
+// CachedBlobResponse returns a response serving the blob with the given
+// digest from the cache, or nil if the blob isn't cached for the repository
+// in the request; blobs are shared between proxies, so serving one which was
+// only fetched for another repository would bypass that repository's access
+// control
+func (rp *RegistryProxy) CachedBlobResponse(req *http.Request, digest string) *http.Response {
+	f, size, ok := rp.Blobs.Open(rp.BlobCacheRepoKey(req), digest)
+	if !ok {
+		return nil
+	}
+	registryLogger.Info("RegistryProxy.CachedBlobResponse: serving blob from cache", "digest", digest, "size", size, "url", req.URL)
+
+	resp := NewResponse(req, http.StatusOK, "application/octet-stream", f, size)
+	if req.Method == http.MethodHead {
+		f.Close() //nolint
+		resp.Body = http.NoBody
+	}
+	resp.Header.Set("Docker-Content-Digest", digest)
+	resp.Header.Set("Etag", fmt.Sprintf(`"%s"`, digest))
+	return resp
+}
+
+// CacheBlobResponse arranges for the blob in the given upstream response to
+// be written into the cache as it streams to the client. Registries commonly
+// redirect blob downloads to a CDN, these redirects are followed here so the
+// blob passes through the proxy and can be cached.
+func (rp *RegistryProxy) CacheBlobResponse(req *http.Request, resp *http.Response, digest string) *http.Response {
+	if req.Header.Get("Range") != "" {
+		// partial content can't be verified against the digest
+		return resp
+	}
+
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		location, err := req.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			registryLogger.Warn("RegistryProxy.CacheBlobResponse: unable to parse redirect location", "location", resp.Header.Get("Location"), "error", err)
+			return resp
+		}
+		ctx, span := tracer.Start(req.Context(), "RegistryProxy.FollowBlobRedirect", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attrUpstreamHost.String(location.Host), attrDigest.String(digest)))
+		blobReq, err := http.NewRequestWithContext(ctx, http.MethodGet, location.String(), nil)
+		if err != nil {
+			registryLogger.Warn("RegistryProxy.CacheBlobResponse: unable to build blob request", "location", location, "error", err)
+			EndSpan(span, nil, err)
+			return resp
+		}
+		blobReq.Header.Set("User-Agent", req.Header.Get("User-Agent"))
+		InjectTraceContext(blobReq)
+		registryLogger.Debug("RegistryProxy.CacheBlobResponse: following blob redirect", "location", location)
+		blobResp, err := blobRedirectClient.Do(blobReq)
+		EndSpan(span, blobResp, err)
+		if err != nil {
+			registryLogger.Warn("RegistryProxy.CacheBlobResponse: blob redirect request failed", "location", location, "error", err)
+			return resp
+		}
+		if blobResp.StatusCode != http.StatusOK {
+			registryLogger.Warn("RegistryProxy.CacheBlobResponse: blob redirect returned an unexpected status", "location", location, "status", blobResp.StatusCode)
+			blobResp.Body.Close() //nolint
+			return resp
+		}
+		resp.Body.Close() //nolint
+		blobResp.Header.Set("Docker-Content-Digest", digest)
+		blobResp.Request = req
+		resp = blobResp
+	case http.StatusOK:
+	default:
+		return resp
+	}
+
+	resp.Body = rp.Blobs.Tee(rp.BlobCacheRepoKey(req), digest, resp.Body)
+	return resp
+}
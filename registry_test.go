@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+// mintTestToken returns a token like the ones TokenProxy issues
+func mintTestToken(key paseto.V4SymmetricKey, proxies []string, registry string, scopes ...string) string {
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Minute))
+	token.SetString(tokenKeyUpstreamToken, "upstream-token")
+	token.Set(tokenKeyProxies, proxies) //nolint
+	token.SetString(tokenKeyRegistry, registry)
+	token.Set(tokenKeyScopes, scopes) //nolint
+	return token.V4Encrypt(key, nil)
+}
+
+func TestTokenBinding(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) //nolint
+	})
+	front := newTestServer(t, "proxies:\n"+
+		proxyYAML("a/", upstream, "org-a", "actions: [pull, push]")+
+		proxyYAML("b/", upstream, "org-b", "actions: [pull, push]"))
+	_, pullToken := getToken(t, front, "scope=repository:a/app:pull", "", "")
+
+	secretKey, _ := paseto.V4SymmetricKeyFromHex(testSecretKey)
+	registryHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{"granted pull", http.MethodGet, "/v2/a/app/manifests/latest", pullToken, http.StatusOK},
+		{"granted head", http.MethodHead, "/v2/a/app/manifests/latest", pullToken, http.StatusOK},
+		{"other repository of the same proxy", http.MethodGet, "/v2/a/other/manifests/latest", pullToken, http.StatusForbidden},
+		{"replayed against another proxy", http.MethodGet, "/v2/b/app/manifests/latest", pullToken, http.StatusForbidden},
+		{"push with a pull-only token", http.MethodPut, "/v2/a/app/manifests/latest", pullToken, http.StatusForbidden},
+		{"delete with a pull-only token", http.MethodDelete, "/v2/a/app/manifests/latest", pullToken, http.StatusForbidden},
+		{"garbage token", http.MethodGet, "/v2/a/app/manifests/latest", "v4.local.garbage", http.StatusUnauthorized},
+		{"minted with another key", http.MethodGet, "/v2/a/app/manifests/latest",
+			mintTestToken(paseto.NewV4SymmetricKey(), []string{"a/"}, registryHost, "repository:a/app:pull"), http.StatusUnauthorized},
+		{"minted for another registry", http.MethodGet, "/v2/a/app/manifests/latest",
+			mintTestToken(secretKey, []string{"a/"}, "ghcr.io", "repository:a/app:pull"), http.StatusForbidden},
+		{"minted for both proxies", http.MethodGet, "/v2/b/app/manifests/latest",
+			mintTestToken(secretKey, []string{"a/", "b/"}, registryHost, "repository:a/app:pull", "repository:b/app:pull"), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doRequest(t, front, tt.method, tt.path, tt.token)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if resp.StatusCode == http.StatusUnauthorized && resp.Header.Get("Www-Authenticate") == "" {
+				t.Error("401 without a challenge")
+			}
+		})
+	}
+}
+
+func TestDisallowedActions(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) //nolint
+	})
+	front := newTestServer(t, "proxies:\n"+proxyYAML("pull/", upstream, "org")) // pull only by default
+	_, token := getToken(t, front, "scope=repository:pull/app:pull,push", "", "")
+
+	tests := []struct {
+		method string
+		token  string
+		status int
+		code   string // registry error code, if the request is refused
+	}{
+		{http.MethodGet, token, http.StatusOK, ""},
+		{http.MethodHead, token, http.StatusOK, ""},
+		{http.MethodOptions, token, http.StatusOK, ""},
+		{http.MethodPut, token, http.StatusForbidden, errCodeDenied},
+		{http.MethodPost, token, http.StatusForbidden, errCodeDenied},
+		{http.MethodPatch, token, http.StatusForbidden, errCodeDenied},
+		{http.MethodDelete, token, http.StatusForbidden, errCodeDenied},
+		{http.MethodPut, "", http.StatusForbidden, errCodeDenied}, // refused before the token is checked
+		{http.MethodDelete, "", http.StatusForbidden, errCodeDenied},
+		{"PROPFIND", token, http.StatusMethodNotAllowed, errCodeUnsupported},
+	}
+	for i, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			path := fmt.Sprintf("/v2/pull/app/manifests/tag%d", i)
+			resp := doRequest(t, front, tt.method, path, tt.token)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.code == "" {
+				return
+			}
+			if regErr := readRegistryError(t, resp); regErr.Code != tt.code {
+				t.Errorf("error code %s, want %s", regErr.Code, tt.code)
+			}
+			if requests := upstream.Requests(strings.Replace(path, "/pull/", "/org/", 1)); len(requests) != 0 {
+				t.Errorf("refused request was sent upstream")
+			}
+		})
+	}
+}
+
+func TestRewriteResponse(t *testing.T) {
+	var upstream *testUpstream
+	upstream = newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v2/org/team/app/tags/list":
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/org/team/app/tags/list?last=v2&n=2>; rel="next"`)
+			} else {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/v2/org/team/app/tags/list?last=v4&n=2>; rel="next"`, upstream.URL))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"org/team/app","tags":["v1","v2"]}`)) //nolint
+		case "/v2/org/team/outside/tags/list":
+			// names outside the remote prefix can't be reached through the proxy
+			w.Header().Set("Link", `</v2/other/app/tags/list?last=v2&n=2>; rel="next"`)
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"other/app","tags":["v1","v2"]}`)) //nolint
+		case "/v2/org/team/app/blobs/uploads/":
+			w.Header().Set("Location", "/v2/org/team/app/blobs/uploads/uuid-1?_state=abc")
+			w.WriteHeader(http.StatusAccepted)
+		case "/v2/org/team/upload/blobs/uploads/":
+			w.Header().Set("Location", upstream.URL+"/v2/org/team/upload/blobs/uploads/uuid-2")
+			w.WriteHeader(http.StatusAccepted)
+		case "/v2/org/team/foreign/blobs/uploads/":
+			w.Header().Set("Location", "https://uploads.example.com/v2/org/team/foreign/blobs/uploads/uuid-3")
+			w.WriteHeader(http.StatusAccepted)
+		case "/v2/org/team/outside/blobs/uploads/":
+			w.Header().Set("Location", "/v2/other/app/blobs/uploads/uuid-4")
+			w.WriteHeader(http.StatusAccepted)
+		}
+	})
+	front := newTestServer(t, "proxies:\n"+proxyYAML("mirror/", upstream, "org/team", "actions: [pull, push]"))
+	scopes := []string{}
+	for _, name := range []string{"app", "upload", "foreign", "outside"} {
+		scopes = append(scopes, "scope=repository:mirror/"+name+":pull,push")
+	}
+	_, token := getToken(t, front, strings.Join(scopes, "&"), "", "")
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		location string
+		link     string
+		body     string
+	}{
+		{"tags list", http.MethodGet, "/v2/mirror/app/tags/list?n=2",
+			"", `</v2/mirror/app/tags/list?last=v2&n=2>; rel="next"`, `{"name":"mirror/app","tags":["v1","v2"]}`},
+		{"absolute link", http.MethodGet, "/v2/mirror/app/tags/list?last=v2&n=2",
+			"", `</v2/mirror/app/tags/list?last=v4&n=2>; rel="next"`, `{"name":"mirror/app","tags":["v1","v2"]}`},
+		{"tags list outside the remote prefix", http.MethodGet, "/v2/mirror/outside/tags/list",
+			"", `</v2/other/app/tags/list?last=v2&n=2>; rel="next"`, `{"name":"other/app","tags":["v1","v2"]}`},
+		{"upload location", http.MethodPost, "/v2/mirror/app/blobs/uploads/",
+			"/v2/mirror/app/blobs/uploads/uuid-1?_state=abc", "", ""},
+		{"absolute upload location", http.MethodPost, "/v2/mirror/upload/blobs/uploads/",
+			"/v2/mirror/upload/blobs/uploads/uuid-2", "", ""},
+		{"location on another host", http.MethodPost, "/v2/mirror/foreign/blobs/uploads/",
+			"https://uploads.example.com/v2/org/team/foreign/blobs/uploads/uuid-3", "", ""},
+		{"location outside the remote prefix", http.MethodPost, "/v2/mirror/outside/blobs/uploads/",
+			"/v2/other/app/blobs/uploads/uuid-4", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doRequest(t, front, tt.method, tt.path, token)
+			body, _ := io.ReadAll(resp.Body)
+			if location := resp.Header.Get("Location"); location != tt.location {
+				t.Errorf("Location %q, want %q", location, tt.location)
+			}
+			if link := resp.Header.Get("Link"); link != tt.link {
+				t.Errorf("Link %q, want %q", link, tt.link)
+			}
+			if string(body) != tt.body || resp.ContentLength != int64(len(tt.body)) {
+				t.Errorf("body %q of length %d, want %q", body, resp.ContentLength, tt.body)
+			}
+		})
+	}
+}
+
+func TestRepositoryFromPath(t *testing.T) {
+	tests := []struct {
+		path, name, kind, reference string
+	}{
+		{"/v2/library/nginx/manifests/latest", "library/nginx", "manifests", "latest"},
+		{"/v2/a/blobs/uploads/", "a", "blobs", "uploads/"},
+		{"/v2/a/blobs/x/manifests/latest", "a/blobs/x", "manifests", "latest"},
+		{"/v2/a/manifests/x/blobs/sha256:abc", "a/manifests/x", "blobs", "sha256:abc"},
+		{"/v2/a/tags/list", "a", "tags", "list"},
+		{"/v2/", "", "", ""},
+	}
+	for _, tt := range tests {
+		name, kind, reference := RepositoryFromPath(tt.path)
+		if name != tt.name || kind != tt.kind || reference != tt.reference {
+			t.Errorf("RepositoryFromPath(%q) = %q, %q, %q; want %q, %q, %q", tt.path, name, kind, reference, tt.name, tt.kind, tt.reference)
+		}
+	}
+}
+
+func TestNestedKindSegments(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) //nolint
+	})
+	front := newTestServer(t, "proxies:\n"+
+		proxyYAML("a", upstream, "org/app", `auth: "Basic cHJveHk6c2VjcmV0"`)+
+		proxyYAML("m/", upstream, "mirror"))
+	_, token := getToken(t, front, "scope=repository:a:pull", "", "")
+
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		upstream string // path the request reaches upstream with, if any
+	}{
+		{"the proxied repository", "/v2/a/manifests/latest", http.StatusOK, "/v2/org/app/manifests/latest"},
+		{"nested blobs segment", "/v2/a/blobs/x/manifests/latest", http.StatusNotFound, "/v2/org/app/blobs/x/manifests/latest"},
+		{"nested manifests segment", "/v2/a/manifests/x/blobs/sha256:abc", http.StatusNotFound, "/v2/org/app/manifests/x/blobs/sha256:abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doRequest(t, front, http.MethodGet, tt.path, token)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := len(upstream.Requests(tt.upstream)); (tt.status == http.StatusOK) != (got > 0) {
+				t.Errorf("%d upstream requests for %s", got, tt.upstream)
+			}
+		})
+	}
+
+	// repositories of a prefix proxy may have such components, but they are
+	// still within the remote prefix
+	_, token = getToken(t, front, "scope=repository:m/blobs/x:pull", "", "")
+	if resp := doRequest(t, front, http.MethodGet, "/v2/m/blobs/x/manifests/latest", token); resp.StatusCode != http.StatusOK {
+		t.Errorf("status %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if len(upstream.Requests("/v2/mirror/blobs/x/manifests/latest")) != 1 {
+		t.Error("request for a nested repository wasn't sent upstream")
+	}
+}
+
+func TestIsRemoteName(t *testing.T) {
+	tests := []struct {
+		local, remote, name string
+		want                bool
+	}{
+		{"a", "org/app", "org/app", true},
+		{"a", "org/app", "org/app/blobs/x", false},
+		{"a", "org/app", "org/other", false},
+		{"a/", "org", "org/app", true},
+		{"a/", "org", "org/app/blobs/x", true},
+		{"a/", "org", "orgx/app", false},
+		{"a/", "", "anything/at/all", true},
+	}
+	for _, tt := range tests {
+		rp := &RegistryProxy{Config: ProxyItem{LocalPrefix: tt.local, RemotePrefix: tt.remote}}
+		if got := rp.IsRemoteName(tt.name); got != tt.want {
+			t.Errorf("proxy %s -> %s: IsRemoteName(%q) = %v, want %v", tt.local, tt.remote, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestUpstreamAuthorization(t *testing.T) {
+	rp := &RegistryProxy{Config: ProxyItem{LocalPrefix: "a", RemotePrefix: "org/app", AuthHeader: "Basic cHJveHk6c2VjcmV0"}}
+	tests := []struct {
+		name          string
+		path          string
+		upstreamToken string
+		want          string
+	}{
+		{"upstream token", "/v2/org/app/manifests/latest", "upstream-token", "Bearer upstream-token"},
+		{"proxy credentials", "/v2/org/app/manifests/latest", "", "Basic cHJveHk6c2VjcmV0"},
+		{"nested repository", "/v2/org/app/blobs/x/manifests/latest", "", ""},
+		{"other repository", "/v2/org/other/manifests/latest", "", ""},
+		{"not a repository path", "/v2/_catalog", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, "https://registry.example.com"+tt.path, nil)
+			if got := rp.UpstreamAuthorization(req, tt.upstreamToken); got != tt.want {
+				t.Errorf("Authorization %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCrossRepositoryMount(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	})
+	front := newTestServer(t, "proxies:\n"+
+		proxyYAML("m/", upstream, "org", "actions: [pull, push]")+
+		proxyYAML("other/", upstream, "org-b"))
+	_, mountToken := getToken(t, front, "scope=repository:m/app:pull,push&scope=repository:m/base:pull", "", "")
+	_, pushToken := getToken(t, front, "scope=repository:m/app:pull,push", "", "")
+
+	tests := []struct {
+		name  string
+		query string
+		token string
+		want  string // query received upstream
+	}{
+		{"mount from a repository of the proxy", "mount=sha256:abc&from=m/base", mountToken, "from=org%2Fbase&mount=sha256%3Aabc"},
+		{"no pull access to the source", "mount=sha256:abc&from=m/base", pushToken, ""},
+		{"source of another proxy", "mount=sha256:abc&from=other/base", mountToken, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := doRequest(t, front, http.MethodPost, "/v2/m/app/blobs/uploads/?"+tt.query, tt.token)
+			if resp.StatusCode != http.StatusAccepted {
+				t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusAccepted)
+			}
+			requests := upstream.Requests("/v2/org/app/blobs/uploads/")
+			if len(requests) == 0 {
+				t.Fatal("upload wasn't sent upstream")
+			}
+			if got := requests[len(requests)-1].URL.RawQuery; got != tt.want {
+				t.Errorf("upstream query %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteName(t *testing.T) {
+	tests := []struct {
+		local, remote, name, want string
+		ok                        bool
+	}{
+		{"a", "org/app", "a", "org/app", true},
+		{"a", "org/app", "a/x", "", false},
+		{"a/", "org", "a/app", "org/app", true},
+		{"a/", "", "a/app", "app", true},
+		{"a/", "org", "b/app", "", false},
+	}
+	for _, tt := range tests {
+		rp := &RegistryProxy{Config: ProxyItem{LocalPrefix: tt.local, RemotePrefix: tt.remote}}
+		if got, ok := rp.RemoteName(tt.name); got != tt.want || ok != tt.ok {
+			t.Errorf("proxy %s -> %s: RemoteName(%q) = %q, %v; want %q, %v", tt.local, tt.remote, tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
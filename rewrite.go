@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// tagsListMaxSize is the largest tags/list response body which is rewritten;
+// larger ones are passed through unchanged
+const tagsListMaxSize = 16 << 20
+
+// linkTargetRegex matches the target URLs in a Link header, e.g.
+// `</v2/backplane/foo/tags/list?last=v1&n=100>; rel="next"`
+var linkTargetRegex = regexp.MustCompile(`<([^>]*)>`)
+
+// RewriteResponse replaces the upstream repository names in the response
+// with the names clients of this proxy use for them: in the Location header
+// (e.g. of upload sessions), in pagination Link headers and in tags/list
+// bodies
+func (rp *RegistryProxy) RewriteResponse(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if location := resp.Header.Get("Location"); location != "" {
+		if local, ok := rp.LocalURL(req, location); ok {
+			registryLogger.Debug("RegistryProxy.RewriteResponse: rewrote location header", "from", location, "to", local)
+			resp.Header.Set("Location", local)
+		}
+	}
+
+	if links := resp.Header.Values("Link"); len(links) > 0 {
+		resp.Header.Del("Link")
+		for _, link := range links {
+			local := linkTargetRegex.ReplaceAllStringFunc(link, func(target string) string {
+				if local, ok := rp.LocalURL(req, strings.Trim(target, "<>")); ok {
+					return "<" + local + ">"
+				}
+				return target
+			})
+			registryLogger.Debug("RegistryProxy.RewriteResponse: rewrote link header", "from", link, "to", local)
+			resp.Header.Add("Link", local)
+		}
+	}
+
+	if _, kind, _ := RepositoryFromPath(req.URL.Path); kind == "tags" && req.Method == http.MethodGet && resp.StatusCode == http.StatusOK {
+		return rp.rewriteTagsList(req, resp)
+	}
+	return resp, nil
+}
+
+// LocalURL translates a URL pointing at a repository of the upstream
+// registry into the path of the same repository on this proxy; it returns
+// false if the URL points elsewhere, e.g. at a blob storage CDN
+func (rp *RegistryProxy) LocalURL(req *http.Request, location string) (string, bool) {
+	u, err := url.Parse(location)
+	if err != nil || (u.Host != "" && u.Host != req.URL.Host) {
+		return "", false
+	}
+	remoteName, kind, reference := RepositoryFromPath(u.Path)
+	if remoteName == "" || !rp.IsRemoteName(remoteName) {
+		return "", false
+	}
+	local := &url.URL{
+		Path:     fmt.Sprintf("/v2/%s/%s/%s", rp.LocalName(remoteName), kind, reference),
+		RawQuery: u.RawQuery,
+	}
+	return local.String(), true
+}
+
+// IsRemoteName returns true if the given upstream repository name is
+// reachable through this proxy, i.e. it is the remote repository of a proxy
+// for a single repository or within the RemotePrefix of any other proxy
+func (rp *RegistryProxy) IsRemoteName(remoteName string) bool {
+	remotePrefix := strings.Trim(rp.Config.RemotePrefix, "/")
+	if !strings.HasSuffix(rp.Config.LocalPrefix, "/") {
+		return remoteName == remotePrefix
+	}
+	return remotePrefix == "" || remoteName == remotePrefix || strings.HasPrefix(remoteName, remotePrefix+"/")
+}
+
+// rewriteTagsList replaces the repository name in a tags/list response body
+func (rp *RegistryProxy) rewriteTagsList(req *http.Request, resp *http.Response) (*http.Response, error) {
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		registryLogger.Debug("RegistryProxy.rewriteTagsList: not rewriting encoded body", "url", req.URL, "encoding", encoding)
+		return resp, nil
+	}
+
+	upstreamBody := resp.Body
+	body, err := io.ReadAll(io.LimitReader(upstreamBody, tagsListMaxSize+1))
+	if err != nil {
+		upstreamBody.Close() //nolint
+		return nil, fmt.Errorf("RegistryProxy.rewriteTagsList: unable to read tags list from upstream; error: %w", err)
+	}
+	if len(body) > tagsListMaxSize {
+		// too large to rewrite, pass it through unchanged
+		resp.Body = ReplayBody(body, upstreamBody)
+		return resp, nil
+	}
+	upstreamBody.Close() //nolint
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	// other fields are kept as they are
+	var tagsList map[string]json.RawMessage
+	var remoteName string
+	if err := json.Unmarshal(body, &tagsList); err != nil {
+		registryLogger.Debug("RegistryProxy.rewriteTagsList: unable to parse tags list", "url", req.URL, "error", err)
+		return resp, nil
+	}
+	if err := json.Unmarshal(tagsList["name"], &remoteName); err != nil || !rp.IsRemoteName(remoteName) {
+		return resp, nil
+	}
+	localName := rp.LocalName(remoteName)
+	tagsList["name"], _ = json.Marshal(localName)
+	rewritten, err := json.Marshal(tagsList)
+	if err != nil {
+		return nil, fmt.Errorf("RegistryProxy.rewriteTagsList: unable to encode tags list; error: %w", err)
+	}
+	registryLogger.Debug("RegistryProxy.rewriteTagsList: rewrote repository name", "from", remoteName, "to", localName)
+
+	resp.Body = io.NopCloser(bytes.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(rewritten)))
+	return resp, nil
+}
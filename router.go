@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+// Router dispatches registry API requests to the RegistryProxy of the
+// ProxyItem which best matches the repository name in the request path. It
+// uses the same matching logic as the token endpoint (Config.BestMatch) so a
+// token scope and a request path always resolve to the same ProxyItem.
+type Router struct {
+	Config    Config
+	SecretKey paseto.V4SymmetricKey
+	handlers  map[string]http.Handler // keyed by ProxyItem.LocalPrefix
+}
+
+// NewRouter returns a Router with a RegistryProxy for each configured proxy
+func NewRouter(cfg Config, secretKey paseto.V4SymmetricKey, blobs *BlobCache, manifests *ManifestCache, endpoints *TokenEndpoints) *Router {
+	rt := &Router{
+		Config:    cfg,
+		SecretKey: secretKey,
+		handlers:  map[string]http.Handler{},
+	}
+	for _, proxy := range cfg.Proxies {
+		rt.handlers[proxy.LocalPrefix] = NewRegistryProxy(proxy, secretKey, cfg.ProxyFQDN, blobs, manifests, endpoints)
+	}
+	return rt
+}
+
+// ServeHTTP routes the request to the matching RegistryProxy
+func (rt *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v2/" {
+		// clients holding a valid token (e.g. after `docker login`) are told
+		// they're authenticated, everyone else gets the token endpoint
+		if _, err := ParseToken(rt.SecretKey, req.Header.Get("Authorization")); err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte("{}")) //nolint
+			return
+		}
+		ServeServiceDiscoveryEndpoint(w, req)
+		return
+	}
+
+	name, _, _ := RepositoryFromPath(req.URL.Path)
+	if name == "" {
+		registryLogger.Debug("Router.ServeHTTP: unsupported path", "path", req.URL.Path)
+		metricRequests.WithLabelValues("", EndpointKind(req.URL.Path), "404").Inc()
+		NewRegistryError(http.StatusNotFound, errCodeUnsupported, "the operation is unsupported").Write(w)
+		return
+	}
+
+	proxy, err := rt.Config.Match(name)
+	if err != nil {
+		registryLogger.Debug("Router.ServeHTTP: no proxy matches repository", "name", name, "path", req.URL.Path)
+		metricRequests.WithLabelValues("", EndpointKind(req.URL.Path), "404").Inc()
+		NewRegistryError(http.StatusNotFound, errCodeNameUnknown, "repository name not known to registry").Write(w)
+		return
+	}
+
+	registryLogger.Debug("Router.ServeHTTP: routing request", "path", req.URL.Path, "proxy", proxy.LocalPrefix)
+	rt.handlers[proxy.LocalPrefix].ServeHTTP(w, req)
+}
@@ -16,11 +16,14 @@
 // alpha-numeric           := /[a-z0-9]+/
 // separator               := /[_.]|__|[-]*/
 //
+// Registries also use "*" as an action, e.g. in "registry:catalog:*".
+//
 // See also: https://distribution.github.io/distribution/spec/auth/token/
 package main
 
 import (
 	"fmt"
+	"net/http"
 	"regexp"
 	"strings"
 )
@@ -32,48 +35,131 @@ type TokenScope struct {
 }
 
 type ResourceScope struct {
-	ResourceType    string
+	ResourceType    string // e.g. "repository" or "registry"
+	ResourceClass   string // e.g. "plugin" in "repository(plugin)", usually empty
 	ResourceName    string
 	ResourceActions []string
-	HostName        string
-	Components      string
+	HostName        string // the registry host name at the start of ResourceName, if any
+	Components      string // ResourceName without the HostName
+}
+
+var (
+	resourceTypeRegex = regexp.MustCompile(`^(?P<type>[a-z0-9]+)(?:\((?P<class>[a-z0-9]+)\))?$`)
+	resourceNameRegex = regexp.MustCompile(`^(?:(?P<hostname>` +
+		`(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?` +
+		`)/)?(?P<components>` +
+		`[a-z0-9]+(?:(?:[_.]|__|[-]*)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[_.]|__|[-]*)[a-z0-9]+)*)*` +
+		`)$`)
+	resourceActionRegex = regexp.MustCompile(`^(?:[a-z]*|\*)$`)
+)
+
+// ParseScopes parses a scope string holding one or more space separated
+// resource scopes, e.g. "repository:samalba/my-app:pull,push registry:catalog:*"
+func ParseScopes(scope string) ([]ResourceScope, error) {
+	result := []ResourceScope{}
+	for _, resourceScope := range strings.Fields(scope) {
+		parsed, err := ParseResourceScope(resourceScope)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *parsed)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("ParseScopes: no resource scope found in scope string; string: %s", scope)
+	}
+	return result, nil
 }
 
 // ParseResourceScope parses the given docker auth token resource scope string
-// and returns a ResourceScope struct
+// and returns a ResourceScope struct; given "repository:samalba/my-app:pull,push"
+// the type is "repository", the name "samalba/my-app" and the actions "pull"
+// and "push"
 func ParseResourceScope(scope string) (*ResourceScope, error) {
-	var ScopeRegex = regexp.MustCompile(`^(?P<type>[a-z0-9]+(?:\([a-z0-9]+\))?):(?P<name>(?P<hostname>(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])*(?:\:[0-9]+)?/)?(?P<components>[a-z0-9]+(?:(?:[_.]|__|[-]*)[a-z0-9]+)?(?:/[a-z0-9]+(?:(?:[_.]|__|[-]*)[a-z0-9]+)?)*)):(?P<actions>[a-z]*(?:,[a-z]*)*)$`)
-	// given the input: "repository:samalba/my-app:pull,push"
-	// ...we get the following named capture groups:
-	// type: repository
-	// name: samalba/my-app
-	// hostname: samalba/
-	// components: my-app
-	// actions: pull,push
+	// the name may contain a colon (before a port number) but the type and
+	// the actions can't
+	resourceType, rest, found := strings.Cut(scope, ":")
+	separator := strings.LastIndex(rest, ":")
+	if !found || separator == -1 {
+		return nil, fmt.Errorf("ParseResourceScope: unable to parse scope string; string: %s", scope)
+	}
+	name, actions := rest[:separator], rest[separator+1:]
 
-	mm, matched := MatchMap(ScopeRegex, scope)
+	typeMatch, matched := MatchMap(resourceTypeRegex, resourceType)
 	if !matched {
-		return nil, fmt.Errorf("ParseResourceScope: unable to parse scope string; string: %s", scope)
+		return nil, fmt.Errorf("ParseResourceScope: invalid resource type in scope string; string: %s", scope)
+	}
+	nameMatch, matched := MatchMap(resourceNameRegex, name)
+	if !matched {
+		return nil, fmt.Errorf("ParseResourceScope: invalid resource name in scope string; string: %s", scope)
+	}
+	result := &ResourceScope{
+		ResourceType:    typeMatch["type"],
+		ResourceClass:   typeMatch["class"],
+		ResourceName:    name,
+		ResourceActions: strings.Split(actions, ","),
+		HostName:        nameMatch["hostname"],
+		Components:      nameMatch["components"],
+	}
+	for _, action := range result.ResourceActions {
+		if !resourceActionRegex.MatchString(action) {
+			return nil, fmt.Errorf("ParseResourceScope: invalid action in scope string; string: %s", scope)
+		}
 	}
 
-	result := &ResourceScope{}
-	result.ResourceType = mm["type"]
-	result.ResourceName = mm["name"]
-	result.HostName = strings.TrimRight(mm["hostname"], "/")
-	result.Components = mm["components"]
-	result.ResourceActions = strings.Split(mm["actions"], ",")
+	// the first component can also be read as a host name; like docker we
+	// only take it for one if it looks like one
+	if result.HostName != "" && !strings.ContainsAny(result.HostName, ".:") &&
+		result.HostName != "localhost" && result.HostName == strings.ToLower(result.HostName) {
+		result.HostName = ""
+		result.Components = name
+	}
 
 	return result, nil
 }
 
-// ToString returns the string form of the ResourceScope
+// String returns the string form of the ResourceScope
 func (rs *ResourceScope) String() string {
+	resourceType := rs.ResourceType
+	if rs.ResourceClass != "" {
+		resourceType = fmt.Sprintf("%s(%s)", rs.ResourceType, rs.ResourceClass)
+	}
 	return strings.Join(
 		[]string{
-			rs.ResourceType,
+			resourceType,
 			rs.ResourceName,
 			strings.Join(rs.ResourceActions, ","),
 		},
 		":",
 	)
 }
+
+// IsRepository returns true if the scope is for a repository (of any class)
+func (rs *ResourceScope) IsRepository() bool {
+	return rs.ResourceType == "repository"
+}
+
+// HasAction returns true if the given action is among the scope's actions
+func (rs *ResourceScope) HasAction(action string) bool {
+	for _, a := range rs.ResourceActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// RequiredAction returns the scope action a client needs in order to perform
+// a registry request with the given HTTP method, or an empty string if the
+// method isn't part of the registry API
+func RequiredAction(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return "pull"
+	case http.MethodDelete:
+		return "delete"
+	case http.MethodPut, http.MethodPost, http.MethodPatch:
+		return "push"
+	default:
+		return ""
+	}
+}
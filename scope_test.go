@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResourceScope(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  *ResourceScope // nil if parsing must fail
+	}{
+		{"repository:samalba/my-app:pull,push", &ResourceScope{ResourceType: "repository", ResourceName: "samalba/my-app",
+			ResourceActions: []string{"pull", "push"}, Components: "samalba/my-app"}},
+		{"registry:catalog:*", &ResourceScope{ResourceType: "registry", ResourceName: "catalog",
+			ResourceActions: []string{"*"}, Components: "catalog"}},
+		{"repository(plugin):vieux/sshfs:pull", &ResourceScope{ResourceType: "repository", ResourceClass: "plugin", ResourceName: "vieux/sshfs",
+			ResourceActions: []string{"pull"}, Components: "vieux/sshfs"}},
+		{"repository:registry.example.com/app:pull", &ResourceScope{ResourceType: "repository", ResourceName: "registry.example.com/app",
+			ResourceActions: []string{"pull"}, HostName: "registry.example.com", Components: "app"}},
+		{"repository:Registry.Example.COM/team/app:pull", &ResourceScope{ResourceType: "repository", ResourceName: "Registry.Example.COM/team/app",
+			ResourceActions: []string{"pull"}, HostName: "Registry.Example.COM", Components: "team/app"}},
+		{"repository:Registry/app:pull", &ResourceScope{ResourceType: "repository", ResourceName: "Registry/app",
+			ResourceActions: []string{"pull"}, HostName: "Registry", Components: "app"}},
+		{"repository:localhost:5000/app:pull,push", &ResourceScope{ResourceType: "repository", ResourceName: "localhost:5000/app",
+			ResourceActions: []string{"pull", "push"}, HostName: "localhost:5000", Components: "app"}},
+		{"repository:registry.local:5000/team/app:delete", &ResourceScope{ResourceType: "repository", ResourceName: "registry.local:5000/team/app",
+			ResourceActions: []string{"delete"}, HostName: "registry.local:5000", Components: "team/app"}},
+		{"repository:localhost/app:pull", &ResourceScope{ResourceType: "repository", ResourceName: "localhost/app",
+			ResourceActions: []string{"pull"}, HostName: "localhost", Components: "app"}},
+		{"repository:team/app:pull", &ResourceScope{ResourceType: "repository", ResourceName: "team/app",
+			ResourceActions: []string{"pull"}, Components: "team/app"}},
+		{"repository:a__b/c-d--e/f.g:pull", &ResourceScope{ResourceType: "repository", ResourceName: "a__b/c-d--e/f.g",
+			ResourceActions: []string{"pull"}, Components: "a__b/c-d--e/f.g"}},
+		{"repository:app:", &ResourceScope{ResourceType: "repository", ResourceName: "app",
+			ResourceActions: []string{""}, Components: "app"}},
+		{"repository:Team/App:pull", nil},
+		{"repository:team/app", nil},
+		{"repository:team/app:Pull", nil},
+		{"repository:team/app:pull,**", nil},
+		{"repository:/app:pull", nil},
+		{"repository:team//app:pull", nil},
+		{"repository:-team/app:pull", nil},
+		{"repository:registry.local:port/app:pull", nil},
+		{"Repository:team/app:pull", nil},
+		{"repository(plugin:team/app:pull", nil},
+		{"repository(Plugin):team/app:pull", nil},
+		{":team/app:pull", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			got, err := ParseResourceScope(tt.scope)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("ParseResourceScope(%q) = %+v, want an error", tt.scope, got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("ParseResourceScope(%q) = %+v, %v; want %+v", tt.scope, got, err, tt.want)
+			}
+			if s := got.String(); s != tt.scope {
+				t.Errorf("String() = %q, want %q", s, tt.scope)
+			}
+		})
+	}
+}
+
+func TestParseScopes(t *testing.T) {
+	tests := []struct {
+		scope string
+		want  []string // the String() of each resource scope; nil if parsing must fail
+	}{
+		{"repository:a/b:pull", []string{"repository:a/b:pull"}},
+		{"repository:a/b:pull repository:c/d:pull,push registry:catalog:*",
+			[]string{"repository:a/b:pull", "repository:c/d:pull,push", "registry:catalog:*"}},
+		{"  repository:a/b:pull \t repository(plugin):c/d:pull ", []string{"repository:a/b:pull", "repository(plugin):c/d:pull"}},
+		{"repository:localhost:5000/a:pull repository:Host.Example.com/b:push", []string{"repository:localhost:5000/a:pull", "repository:Host.Example.com/b:push"}},
+		{"repository:a/b:pull repository:C/d", nil},
+		{"", nil},
+		{"   ", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scope, func(t *testing.T) {
+			got, err := ParseScopes(tt.scope)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("ParseScopes(%q) = %+v, want an error", tt.scope, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseScopes(%q) error %v", tt.scope, err)
+			}
+			scopes := []string{}
+			for _, scope := range got {
+				scopes = append(scopes, scope.String())
+			}
+			if !reflect.DeepEqual(scopes, tt.want) {
+				t.Errorf("ParseScopes(%q) = %q, want %q", tt.scope, scopes, tt.want)
+			}
+		})
+	}
+}
+
+// parsed scopes must render back into the string they were parsed from
+func FuzzParseResourceScope(f *testing.F) {
+	for _, seed := range []string{
+		"repository:samalba/my-app:pull,push",
+		"registry:catalog:*",
+		"repository(plugin):vieux/sshfs:pull",
+		"repository:Registry.Example.COM/team/app:pull",
+		"repository:localhost:5000/app:pull,push",
+		"repository:a__b/c-d--e/f.g:",
+		"repository:a/b:pull repository:c/d:push",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, scope string) {
+		if parsed, err := ParseResourceScope(scope); err == nil {
+			if s := parsed.String(); s != scope {
+				t.Fatalf("ParseResourceScope(%q).String() = %q", scope, s)
+			}
+			reparsed, err := ParseResourceScope(parsed.String())
+			if err != nil || !reflect.DeepEqual(reparsed, parsed) {
+				t.Fatalf("ParseResourceScope(%q) = %+v, %v; want %+v", parsed.String(), reparsed, err, parsed)
+			}
+		}
+
+		parsed, err := ParseScopes(scope)
+		if err != nil {
+			return
+		}
+		rendered := []string{}
+		for _, resourceScope := range parsed {
+			rendered = append(rendered, resourceScope.String())
+		}
+		if joined := strings.Join(rendered, " "); joined != strings.Join(strings.Fields(scope), " ") {
+			t.Fatalf("ParseScopes(%q) rendered as %q", scope, joined)
+		}
+		reparsed, err := ParseScopes(strings.Join(rendered, " "))
+		if err != nil || !reflect.DeepEqual(reparsed, parsed) {
+			t.Fatalf("ParseScopes(%q) = %+v, %v; want %+v", strings.Join(rendered, " "), reparsed, err, parsed)
+		}
+	})
+}
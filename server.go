@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+// configPollInterval is how often the config file is checked for changes
+// when watch_config is enabled
+const configPollInterval = 5 * time.Second
+
+// Runtime holds the request handlers built from one version of the config
+type Runtime struct {
+	Config Config
+	Mux    *http.ServeMux
+}
+
+// Server serves requests using the current Runtime, which is replaced
+// atomically when the configuration is reloaded; requests which are already
+// in flight finish with the Runtime they started with. The caches and the
+// discovered token endpoints live as long as the Server so they survive
+// reloads.
+type Server struct {
+	ConfigPath string
+
+	blobs     *BlobCache
+	manifests *ManifestCache
+	tokens    *TokenCache
+
+	draining  atomic.Bool // set once the server is shutting down
+	runtime   atomic.Pointer[Runtime]
+	reloadMu  sync.Mutex // serializes reloads
+	endpoints *TokenEndpoints
+}
+
+// NewServer returns a Server for the given initial configuration
+func NewServer(configPath string, config Config) (*Server, error) {
+	s := &Server{
+		ConfigPath: configPath,
+		tokens:     NewTokenCache(),
+		endpoints:  NewTokenEndpoints(),
+	}
+
+	// the blob and manifest caches are optional
+	if config.CacheDir != "" {
+		maxSize, _ := ParseSize(config.CacheMaxSize) // validated by LoadConfig
+		blobs, err := NewBlobCache(config.CacheDir, maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set up blob cache; error: %w", err)
+		}
+		s.blobs = blobs
+	}
+	if config.ManifestCacheEntries > 0 {
+		s.manifests = NewManifestCache(config.ManifestCacheEntries)
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	runtime, err := s.build(config)
+	if err != nil {
+		return nil, err
+	}
+	s.runtime.Store(runtime)
+	return s, nil
+}
+
+// ServeHTTP hands the request to the current Runtime
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.runtime.Load().Mux.ServeHTTP(w, req)
+}
+
+// ServeReady serves the readiness check, which fails once the server has
+// started shutting down
+func (s *Server) ServeReady(w http.ResponseWriter, req *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n")) //nolint
+}
+
+// Shutdown reports unready for shutdown_delay while load balancers stop
+// sending new requests, then stops the given HTTP servers (nil ones are
+// skipped) accepting connections and waits for their in-flight requests; it
+// returns an error if they don't all finish within shutdown_timeout
+func (s *Server) Shutdown(httpServers ...*http.Server) error {
+	current := s.runtime.Load().Config
+	shutdownDelay, _ := time.ParseDuration(current.ShutdownDelay)     // validated by LoadConfig
+	shutdownTimeout, _ := time.ParseDuration(current.ShutdownTimeout) // validated by LoadConfig
+	s.draining.Store(true)
+	logger.Info("Server.Shutdown: shutting down", "delay", shutdownDelay, "timeout", shutdownTimeout)
+	time.Sleep(shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	var errs []error
+	for _, httpServer := range httpServers {
+		if httpServer == nil {
+			continue
+		}
+		if err := httpServer.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("Server.Shutdown: connections to %s did not drain before the shutdown timeout; error: %w", httpServer.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// build validates the given configuration and sets up the request handlers
+// for it; the caller must hold s.reloadMu
+func (s *Server) build(config Config) (*Runtime, error) {
+	// the secret key is used to process the PASETO tokens we issue to clients
+	if config.SecretKey == "" {
+		return nil, fmt.Errorf("SecretKey not found in config")
+	}
+	pasetoSecretKey, err := paseto.V4SymmetricKeyFromHex(config.SecretKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse PASETO symmetric key; error: %w", err)
+	}
+
+	// the authenticator checks the credentials of clients requesting tokens
+	auth, err := NewAuthenticator(config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to set up client authentication; error: %w", err)
+	}
+
+	// the token endpoints of registries we haven't used yet are discovered
+	// in the background, so their first clients don't wait for it; failed
+	// discoveries are retried when the registry is first used
+	undiscovered := map[string]bool{}
+	for _, proxy := range config.Proxies {
+		logger.Info("setup proxy", "proxy", proxy.LocalPrefix, "registry", proxy.RegistryHost, "priority", proxy.Priority)
+		if proxy.TokenRealm == "" && !s.endpoints.Known(proxy.RegistryURL()) {
+			undiscovered[proxy.RegistryURL()] = true
+		}
+	}
+	for registryURL := range undiscovered {
+		go func() {
+			if _, err := s.endpoints.Get(context.Background(), registryURL); err != nil {
+				logger.Warn("Server.build: unable to discover the token endpoint of registry", "registry", registryURL, "error", err)
+			}
+		}()
+	}
+
+	// set up http handlers; all registry API requests are routed through the
+	// Router so they match proxies the same way the token endpoint does
+	mux := http.NewServeMux()
+	mux.Handle("/_token", NewTokenProxy(config, pasetoSecretKey, auth, s.tokens, s.endpoints))
+	mux.Handle("/v2/", NewRouter(config, pasetoSecretKey, s.blobs, s.manifests, s.endpoints))
+	mux.HandleFunc("/_ready", s.ServeReady)
+	if config.Admin.Enabled() {
+		mux.Handle("/_admin/loglevel", &LogLevelHandler{Admin: config.Admin, Auth: auth, FQDN: config.ProxyFQDN})
+	}
+
+	return &Runtime{Config: config, Mux: mux}, nil
+}
+
+// Reload loads the configuration file again and, if it is valid, switches
+// to it; on failure the current configuration stays in use. Listener, cache,
+// metrics, tracing, access log and log format settings can't be changed by a
+// reload.
+func (s *Server) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	config, err := LoadConfig(s.ConfigPath)
+	if err != nil {
+		return fmt.Errorf("Server.Reload: config loading error; error: %w", err)
+	}
+	runtime, err := s.build(config)
+	if err != nil {
+		return fmt.Errorf("Server.Reload: invalid configuration; error: %w", err)
+	}
+
+	config.ApplyLogSettings()
+	previous := s.runtime.Swap(runtime)
+	LogConfigDiff(previous.Config, config)
+	if config.ListenAddr != previous.Config.ListenAddr || config.ListenPort != previous.Config.ListenPort ||
+		config.CacheDir != previous.Config.CacheDir || config.CacheMaxSize != previous.Config.CacheMaxSize ||
+		config.ManifestCacheEntries != previous.Config.ManifestCacheEntries || config.MetricsAddr != previous.Config.MetricsAddr ||
+		config.Tracing != previous.Config.Tracing || config.AccessLog != previous.Config.AccessLog || config.LogFormat != previous.Config.LogFormat {
+		logger.Warn("Server.Reload: listener, cache, metrics, tracing, access log and log format settings only take effect after a restart")
+	}
+	return nil
+}
+
+// WatchSignals reloads the configuration whenever the process receives SIGHUP
+func (s *Server) WatchSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		logger.Info("Server.WatchSignals: received SIGHUP, reloading configuration")
+		if err := s.Reload(); err != nil {
+			logger.Error("Server.WatchSignals: reload failed", "error", err)
+		}
+	}
+}
+
+// WatchFile polls the configuration file every interval and reloads it when
+// it changes, until the server starts shutting down
+func (s *Server) WatchFile(interval time.Duration) {
+	path := s.runtime.Load().Config.path
+	lastInfo, _ := os.Stat(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.draining.Load() {
+			return
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			logger.Warn("Server.WatchFile: unable to check config file", "file", path, "error", err)
+			continue
+		}
+		if lastInfo != nil && info.ModTime().Equal(lastInfo.ModTime()) && info.Size() == lastInfo.Size() {
+			continue
+		}
+		lastInfo = info
+		logger.Info("Server.WatchFile: config file changed, reloading configuration", "file", path)
+		if err := s.Reload(); err != nil {
+			logger.Error("Server.WatchFile: reload failed", "error", err)
+		}
+	}
+}
+
+// LogConfigDiff logs the proxies which were added, removed or changed
+// between the two configurations
+func LogConfigDiff(previous, current Config) {
+	changes := 0
+	for name, proxy := range current.Proxies {
+		previousProxy, ok := previous.Proxies[name]
+		switch {
+		case !ok:
+			logger.Info("config reload: proxy added", "proxy", name, "registry", proxy.RegistryHost, "remote", proxy.RemotePrefix)
+			changes++
+		case !reflect.DeepEqual(previousProxy, proxy):
+			logger.Info("config reload: proxy changed", "proxy", name, "registry", proxy.RegistryHost, "remote", proxy.RemotePrefix)
+			changes++
+		}
+	}
+	for name, proxy := range previous.Proxies {
+		if _, ok := current.Proxies[name]; !ok {
+			logger.Info("config reload: proxy removed", "proxy", name, "registry", proxy.RegistryHost, "remote", proxy.RemotePrefix)
+			changes++
+		}
+	}
+	logger.Info("config reload: configuration reloaded", "proxies", len(current.Proxies), "proxy_changes", changes)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+// a configuration which fails to load or build must not change the log settings
+func TestReloadLogSettings(t *testing.T) {
+	previousLimit, previousLevel, previousStartupLevel := debugBodyLimit.Load(), logLevel.Level(), startupLogLevel
+	t.Cleanup(func() {
+		debugBodyLimit.Store(previousLimit)
+		logLevel.Set(previousLevel)
+		startupLogLevel = previousStartupLevel
+	})
+	startupLogLevel = "INFO"
+	debugBodyLimit.Store(4096)
+	logLevel.Set(slog.LevelWarn)
+
+	path := writeTestFile(t, "config.yaml", "secret_key: "+testSecretKey+"\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reload := func(configYAML string) error {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(configYAML), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return server.Reload()
+	}
+
+	tests := []struct {
+		name   string
+		config string
+		valid  bool
+		limit  int64
+		level  string
+	}{
+		{"invalid proxy", "secret_key: " + testSecretKey + "\ndebug_body_limit: 1KiB\nlog_level: DEBUG\nproxies:\n  \"a/\":\n    registry: ghcr.io\n    actions: [destroy]\n", false, 4096, "WARN"},
+		{"invalid secret key", "debug_body_limit: 1KiB\nlog_level: DEBUG\nsecret_key: nope\n", false, 4096, "WARN"},
+		{"valid", "secret_key: " + testSecretKey + "\ndebug_body_limit: 1KiB\nlog_level: ERROR\n", true, 1024, "ERROR"},
+		{"settings removed", "secret_key: " + testSecretKey + "\n", true, 64 << 10, "INFO"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := reload(tt.config); (err == nil) != tt.valid {
+				t.Errorf("Reload() error %v", err)
+			}
+			if limit := debugBodyLimit.Load(); limit != tt.limit {
+				t.Errorf("debug body limit %d, want %d", limit, tt.limit)
+			}
+			if level := CurrentLogLevels().Level; level != tt.level {
+				t.Errorf("log level %s, want %s", level, tt.level)
+			}
+		})
+	}
+
+	// levels set through the admin endpoint are replaced by the configured
+	// level, or by the startup level if none is configured
+	for _, tt := range []struct{ config, level string }{
+		{"secret_key: " + testSecretKey + "\nlog_level: WARN\n", "WARN"},
+		{"secret_key: " + testSecretKey + "\n", "INFO"},
+	} {
+		(LogLevels{Level: "DEBUG", Components: map[string]string{"token": "ERROR"}}).Apply() //nolint
+		if err := reload(tt.config); err != nil {
+			t.Fatal(err)
+		}
+		if levels := CurrentLogLevels(); levels.Level != tt.level || levels.Components["token"] != "" {
+			t.Errorf("log levels after a reload %+v, want %s and no component levels", levels, tt.level)
+		}
+	}
+}
+
+// newReloadableServer starts a proxy reading its configuration from a file,
+// which the returned function rewrites with the secret key added
+func newReloadableServer(t *testing.T, configYAML string) (*Server, *httptest.Server, func(string)) {
+	t.Helper()
+	path := writeTestFile(t, "config.yaml", "secret_key: "+testSecretKey+"\nproxy_fqdn: reg.example.com\n"+configYAML)
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	server, err := NewServer(path, config)
+	if err != nil {
+		t.Fatalf("NewServer: %v", err)
+	}
+	front := httptest.NewServer(server)
+	t.Cleanup(front.Close)
+	write := func(configYAML string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte("secret_key: "+testSecretKey+"\nproxy_fqdn: reg.example.com\n"+configYAML), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return server, front, write
+}
+
+func TestReload(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	server, front, write := newReloadableServer(t, "proxies:\n"+proxyYAML("a/", upstream, "org"))
+	_, tokenA := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	initial := server.runtime.Load()
+
+	// an invalid configuration keeps the running one
+	write("proxies:\n" + proxyYAML("b/", upstream, "org", "actions: [destroy]"))
+	if err := server.Reload(); err == nil {
+		t.Error("Reload() accepted an invalid configuration")
+	}
+	if server.runtime.Load() != initial {
+		t.Fatal("an invalid configuration replaced the running one")
+	}
+	if resp := doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", tokenA); resp.StatusCode != http.StatusOK {
+		t.Errorf("request through the running proxy: status %d", resp.StatusCode)
+	}
+
+	// a valid one replaces it
+	write("proxies:\n" + proxyYAML("b/", upstream, "org"))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload() error %v", err)
+	}
+	reloaded := server.runtime.Load()
+	if reloaded == initial {
+		t.Fatal("a valid configuration didn't replace the running one")
+	}
+	if _, ok := reloaded.Config.Proxies["b/"]; !ok || len(reloaded.Config.Proxies) != 1 {
+		t.Errorf("reloaded proxies %v, want only b/", reloaded.Config.Proxies)
+	}
+	if resp := doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", tokenA); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("request through the removed proxy: status %d, want 404", resp.StatusCode)
+	}
+	_, tokenB := getToken(t, front, "scope=repository:b/app:pull", "", "")
+	if resp := doRequest(t, front, http.MethodGet, "/v2/b/app/manifests/latest", tokenB); resp.StatusCode != http.StatusOK {
+		t.Errorf("request through the added proxy: status %d", resp.StatusCode)
+	}
+}
+
+// requests in flight during a reload finish with the configuration they
+// started with
+func TestReloadInFlightRequest(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/org/app/manifests/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("manifest")) //nolint
+	})
+	server, front, write := newReloadableServer(t, "proxies:\n"+proxyYAML("a/", upstream, "org"))
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	// fetch the upstream token before the slow request
+	doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", token)
+
+	responses := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, front.URL+"/v2/a/app/manifests/slow", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		responses <- resp
+	}()
+	<-started
+
+	write("proxies:\n" + proxyYAML("b/", upstream, "org"))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload() error %v", err)
+	}
+	close(release)
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request through the removed proxy failed: %v", resp)
+	} else {
+		resp.Body.Close() //nolint
+	}
+	if resp := doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/slow", token); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("new request through the removed proxy: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	server, _, write := newReloadableServer(t, "watch_config: true\nproxies:\n"+proxyYAML("a/", upstream, "org"))
+	t.Cleanup(func() { server.draining.Store(true) })
+	go server.WatchFile(10 * time.Millisecond)
+	initial := server.runtime.Load()
+
+	// the watcher may only look at the file for the first time after it was
+	// changed, so keep changing it
+	changed := "watch_config: true\nproxies:\n" + proxyYAML("a/", upstream, "org") + proxyYAML("b/", upstream, "org")
+	for deadline := time.Now().Add(5 * time.Second); server.runtime.Load() == initial; time.Sleep(20 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the changed config file was not reloaded")
+		}
+		changed += "#\n"
+		write(changed)
+	}
+	if proxies := server.runtime.Load().Config.Proxies; len(proxies) != 2 {
+		t.Errorf("reloaded %d proxies, want 2", len(proxies))
+	}
+}
+
+func TestServeReady(t *testing.T) {
+	server := newTestHandler(t, "")
+	for _, tt := range []struct {
+		draining bool
+		status   int
+	}{{false, http.StatusOK}, {true, http.StatusServiceUnavailable}} {
+		server.draining.Store(tt.draining)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_ready", nil))
+		if rec.Code != tt.status {
+			t.Errorf("draining %v: status %d, want %d", tt.draining, rec.Code, tt.status)
+		}
+	}
+}
+
+// startShutdownTest serves a proxy with the given shutdown settings whose
+// upstream blocks requests for the "slow" manifest until released
+func startShutdownTest(t *testing.T, shutdownYAML string, started, release chan struct{}) (*Server, *httptest.Server) {
+	t.Helper()
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/org/app/manifests/slow" {
+			close(started)
+			<-release
+		}
+		w.Write([]byte("manifest")) //nolint
+	})
+	server := newTestHandler(t, shutdownYAML+"proxies:\n"+proxyYAML("a/", upstream, "org"))
+	front := httptest.NewServer(server)
+	t.Cleanup(front.Close)
+	return server, front
+}
+
+// slowRequest sends a request for the slow manifest and returns the channel
+// its response is delivered on, nil if the request failed
+func slowRequest(front *httptest.Server, token string) chan *http.Response {
+	responses := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, front.URL+"/v2/a/app/manifests/slow", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, _ := http.DefaultClient.Do(req)
+		responses <- resp
+	}()
+	return responses
+}
+
+// the server reports unready during the shutdown delay, then finishes
+// in-flight requests and stops the metrics server before Shutdown returns
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server, front := startShutdownTest(t, "shutdown_delay: 200ms\nshutdown_timeout: 10s\n", started, release)
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", token) // fetch the upstream token
+	responses := slowRequest(front, token)
+	<-started
+
+	metrics := httptest.NewServer(NewMetricsServer("").Handler)
+	t.Cleanup(metrics.Close)
+
+	shutdownErrors := make(chan error, 1)
+	go func() { shutdownErrors <- server.Shutdown(front.Config, nil, metrics.Config) }()
+	for deadline := time.Now().Add(5 * time.Second); !server.draining.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the server didn't start draining")
+		}
+	}
+	// the listener stays open during the delay, but reports unready
+	if resp := doRequest(t, front, http.MethodGet, "/_ready", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/_ready while draining: status %d, want 503", resp.StatusCode)
+	}
+	if resp := doRequest(t, metrics, http.MethodGet, "/metrics", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("/metrics while draining: status %d, want 200", resp.StatusCode)
+	}
+
+	close(release)
+	if resp := <-responses; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("in-flight request failed: %v", resp)
+	} else {
+		resp.Body.Close() //nolint
+	}
+	if err := <-shutdownErrors; err != nil {
+		t.Errorf("Shutdown() error %v", err)
+	}
+	if _, err := http.Get(metrics.URL + "/metrics"); err == nil {
+		t.Error("the metrics server is still serving after the shutdown")
+	}
+}
+
+// Shutdown fails if in-flight requests outlast the shutdown timeout, which
+// makes the process exit with an error
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	server, front := startShutdownTest(t, "shutdown_timeout: 50ms\n", started, release)
+	defer close(release)
+	_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+	doRequest(t, front, http.MethodGet, "/v2/a/app/manifests/latest", token) // fetch the upstream token
+	slowRequest(front, token)
+	<-started
+
+	if err := server.Shutdown(front.Config); err == nil {
+		t.Error("Shutdown() succeeded while a request was in flight")
+	}
+}
+
+// the token endpoints of registries added by a reload are discovered when
+// the reload applies, before their first client
+func TestReloadDiscoversNewRegistries(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	added := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	server, front, write := newReloadableServer(t, "proxies:\n"+proxyYAML("a/", upstream, "org"))
+
+	write("proxies:\n" + proxyYAML("a/", upstream, "org") + proxyYAML("b/", added, "org"))
+	if err := server.Reload(); err != nil {
+		t.Fatalf("Reload() error %v", err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(added.Requests("/v2/")) == 0; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("the added registry was not discovered")
+		}
+	}
+
+	if status, token := getToken(t, front, "scope=repository:b/app:pull", "", ""); status != http.StatusOK || token == "" {
+		t.Fatalf("token status %d", status)
+	}
+	if discoveries := len(added.Requests("/v2/")); discoveries != 1 {
+		t.Errorf("added registry was asked for its token endpoint %d times, want 1", discoveries)
+	}
+}
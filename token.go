@@ -1,48 +1,56 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"strings"
 	"time"
 
 	"aidanwoods.dev/go-paseto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// basicAuthTokenExpiresIn is the lifetime in seconds of the tokens issued for
+// registries which use basic auth rather than a token service
+const basicAuthTokenExpiresIn = 300
+
+// upstreamTokenTimeout is how long a request to an upstream token service may
+// take; the request is shared by all the clients waiting for the token
+const upstreamTokenTimeout = 30 * time.Second
+
+// loginTokenLifetime is how long the tokens issued to clients logging in
+// without a scope are valid
+const loginTokenLifetime = 5 * time.Minute
+
 type TokenProxy struct {
 	ServerConfig Config
 	SecretKey    paseto.V4SymmetricKey
+	Auth         *Authenticator
+	Cache        *TokenCache
+	Endpoints    *TokenEndpoints // the token endpoints of the upstream registries
 }
 
-// // tokenProxyHandler proxies the token requests to the upstream token endpoints;
-// // it adjusts the ?scope= parameter in the query from "repository:foo:..." to
-// // "repository:repoPrefix/foo:.." and reverse proxies the query to the specified
-// // tokenEndpoint.
-// func tokenProxyHandler(config Config, tokenEndpoints map[string]string) http.HandlerFunc {
-// 	// https://distribution.github.io/distribution/spec/auth/scope/
-// 	// tokenProxyHandler: rewrote url:/_token?scope=repository%3Asnakeeyes%3Apull&service=registry.docker.io
-// 	//                           into:https://auth.docker.io/token?scope=repository%3Abackplane%2Fsnakeeyes%3Apull&service=registry.docker.io
-// 	// tokenProxyHandler: rewrote url:/_token?scope=repository%3Asnakeeyes%3Apull&service=registry.docker.io into:https://auth.docker.io/token?scope=repository%3Abackplane%2Fsnakeeyes%3Apull&service=registry.docker.io
-// 	// tokenProxyHandler: rewrote url:/_token?scope=repository%3Apwgen%3Apull&service=registry.docker.io into:https://auth.docker.io/token?scope=repository%3Abackplane%2Fpwgen%3Apull&service=registry.docker.io
-// 	// tokenProxyHandler: rewrote url:/_token?scope=repository%3Apwgen%3Apull&service=registry.docker.io into:https://auth.docker.io/token?scope=repository%3Abackplane%2Fpwgen%3Apull&service=registry.docker.io
-// 	return (&httputil.ReverseProxy{
-// 		FlushInterval: -1,
-// 		Director: ,
-// 	}).ServeHTTP
-// }
-
-// NewTokenProxy handles some things
-func NewTokenProxy(cfg Config, secretKey paseto.V4SymmetricKey) http.HandlerFunc {
+// NewTokenProxy returns a reverse proxy serving our token endpoint; it
+// authenticates clients, gets upstream tokens for the requested scopes and
+// issues PASETO tokens which embed them
+func NewTokenProxy(cfg Config, secretKey paseto.V4SymmetricKey, auth *Authenticator, cache *TokenCache, endpoints *TokenEndpoints) http.HandlerFunc {
 	tp := &TokenProxy{
 		ServerConfig: cfg,
 		SecretKey:    secretKey,
+		Auth:         auth,
+		Cache:        cache,
+		Endpoints:    endpoints,
 	}
 	return (&httputil.ReverseProxy{
 		FlushInterval: -1,
 		Director:      tp.Director,
 		Transport:     tp,
+		ErrorHandler:  ErrorHandler(tokenLogger),
 	}).ServeHTTP
 }
 
@@ -50,130 +58,376 @@ func NewTokenProxy(cfg Config, secretKey paseto.V4SymmetricKey) http.HandlerFunc
 // re-written request to the upstream token service
 func (tp *TokenProxy) Director(req *http.Request) {
 	originalURL := req.URL.String()
+	_, span := tracer.Start(req.Context(), "TokenProxy.Director")
+	defer span.End()
+
+	// these headers are only ever set by us, never by clients
+	req.Header.Del(proxyConfigHeader)
+	req.Header.Del(proxyScopeHeader)
+	req.Header.Del(proxyLoginHeader)
 
 	queryParams := req.URL.Query()
 	serviceParam := queryParams.Get("service")
 	if serviceParam == "" {
-		logger.Error("TokenProxy.Director: no service parameter was found in the request", "url", originalURL)
+		tokenLogger.Info("TokenProxy.Director: no service parameter was found in the request", "url", originalURL)
+		SetDirectorError(req, NewRegistryError(http.StatusBadRequest, errCodeUnsupported, "the service parameter is required"))
 		return
 	}
-	scopeParam := queryParams.Get("scope")
-	if scopeParam == "" {
-		logger.Error("TokenProxy.Director: no scope parameter was found in the request", "url", originalURL)
+	scopeParams := queryParams["scope"]
+	if len(scopeParams) == 0 {
+		// clients request a token without a scope when running `docker login`
+		tokenLogger.Debug("TokenProxy.Director: no scope parameter was found in the request, treating it as a login", "url", originalURL)
+		span.SetAttributes(attribute.Bool("registryproxy.login", true))
+		req.Header.Set(proxyLoginHeader, "true")
 		return
 	}
-	originalScope, err := ParseResourceScope(scopeParam)
+
+	// clients send several scopes (as several parameters, or space separated
+	// in one) e.g. for cross-repository blob mounts; each is matched to its
+	// proxy, and they're all requested from upstream in one token request,
+	// which is only possible if they share the upstream registry and the
+	// credentials used for it
+	scopes, err := ParseScopes(strings.Join(scopeParams, " "))
 	if err != nil {
-		logger.Error("TokenProxy.Director: unable to parse request scope parameter", "error", err, "url", originalURL)
+		tokenLogger.Info("TokenProxy.Director: unable to parse request scope parameter", "scope", scopeParams, "error", err)
+		SetDirectorError(req, NewRegistryError(http.StatusBadRequest, errCodeUnsupported, fmt.Sprintf("invalid scope \"%s\"", strings.Join(scopeParams, " "))))
 		return
 	}
+	var primary ProxyItem
+	proxies := []string{}
+	grantedScopes := []string{}
+	upstreamScopes := []string{}
+	for i, scope := range scopes {
+		proxy, granted, upstream, regErr := tp.RewriteScope(scope)
+		if regErr != nil {
+			SetDirectorError(req, regErr)
+			return
+		}
+		if i == 0 {
+			primary = proxy
+			span.SetAttributes(attrProxy.String(proxy.LocalPrefix), attrUpstreamHost.String(proxy.RegistryHost))
+		} else if !primary.SharesUpstream(proxy) {
+			tokenLogger.Info("TokenProxy.Director: scopes span different upstream registries or credentials",
+				"scopes", scopeParams,
+				"proxy", primary.LocalPrefix,
+				"other_proxy", proxy.LocalPrefix)
+			SetDirectorError(req, NewRegistryError(http.StatusBadRequest, errCodeUnsupported,
+				fmt.Sprintf("scopes %s and %s use different upstream registries or credentials and can't be granted in one token", scopes[0].String(), scope.String())))
+			return
+		}
+		if !slices.Contains(proxies, proxy.LocalPrefix) {
+			proxies = append(proxies, proxy.LocalPrefix)
+		}
+		grantedScopes = append(grantedScopes, granted.String())
+		upstreamScopes = append(upstreamScopes, upstream.String())
+	}
+	queryParams["scope"] = upstreamScopes
+	tokenLogger.Debug("TokenProxy.Director: rewrote scopes in request", "from", grantedScopes, "to", upstreamScopes)
+	span.SetAttributes(attrScope.String(strings.Join(grantedScopes, " ")))
 
-	// we need to identify which of the config.ProxyItem members best matches
-	// the value in the orignalScope
-	proxy, err := tp.ServerConfig.BestMatch(originalScope)
-	if err != nil {
-		logger.Error("TokenProxy.Director: unable to match scope to a known proxy config", "scope", scopeParam, "error", err)
-		return
+	// the request is pointed at the remote token endpoint by RoundTrip, once
+	// the endpoint has been discovered
+	req.URL.RawQuery = queryParams.Encode()
+	req.RequestURI = "" // clearing this to avoid conflicts
+
+	// add the proxy config keys to the request so the transport function can
+	// use them; the first proxy is the one the upstream request is made for
+	for _, proxy := range proxies {
+		req.Header.Add(proxyConfigHeader, proxy)
+	}
+	for _, scope := range grantedScopes {
+		req.Header.Add(proxyScopeHeader, scope)
 	}
+}
 
-	// update the host and set the service param
-	queryParams.Set("service", tokenEndpoints[proxy.RegistryHost].Service) // e.g. registry.docker.io
+// RewriteScope matches the given scope from a client's token request to a
+// proxy; it returns the proxy, the scope which is granted (in local terms,
+// with any actions the proxy doesn't allow removed) and the scope to request
+// from the upstream token service
+func (tp *TokenProxy) RewriteScope(originalScope ResourceScope) (ProxyItem, *ResourceScope, *ResourceScope, *RegistryError) {
+	// only repositories are proxied, e.g. the upstream catalog isn't
+	if !originalScope.IsRepository() {
+		tokenLogger.Info("TokenProxy.RewriteScope: rejected scope which isn't for a repository", "scope", originalScope.String())
+		return ProxyItem{}, nil, nil, NewRegistryError(http.StatusBadRequest, errCodeUnsupported, fmt.Sprintf("scope \"%s\" is not supported, only repository scopes are", originalScope.String()))
+	}
 
-	newScope, err := ParseResourceScope(scopeParam)
+	// we need to identify which of the config.ProxyItem members best matches
+	// the value in the orignalScope
+	proxy, err := tp.ServerConfig.BestMatch(&originalScope)
 	if err != nil {
-		panic("TokenProxy.Director: unable to parse scope param a second time, this shouldn't happen")
+		tokenLogger.Info("TokenProxy.RewriteScope: unable to match scope to a known proxy config", "scope", originalScope.String(), "error", err)
+		return ProxyItem{}, nil, nil, NewRegistryError(http.StatusNotFound, errCodeNameUnknown, fmt.Sprintf("repository name not known to registry: %s", originalScope.ResourceName))
 	}
-	newScope.ResourceName = strings.Trim(fmt.Sprintf("%s/%s", proxy.RemotePrefix, strings.TrimPrefix(newScope.ResourceName, proxy.LocalPrefix)), "/")
-	queryParams.Set("scope", newScope.String())
-	logger.Debug("TokenProxy.Director: rewrote scope in request", "from", originalScope, "to", newScope)
 
-	// change the request from a request to our token endpoint to the remote token endpoint
-	u, _ := url.Parse(tokenEndpoints[proxy.RegistryHost].Realm) // e.g. https://auth.docker.io/token
-	u.RawQuery = queryParams.Encode()
-	req.Host = u.Host
-	req.URL = u
-	req.RequestURI = "" // clearing this to avoid conflicts
+	// strip any actions the proxy doesn't allow from the requested scope
+	if allowed := proxy.FilterActions(originalScope.ResourceActions); len(allowed) != len(originalScope.ResourceActions) {
+		tokenLogger.Info("TokenProxy.RewriteScope: removed disallowed actions from scope",
+			"proxy", proxy.LocalPrefix,
+			"requested", originalScope.ResourceActions,
+			"allowed", allowed)
+		originalScope.ResourceActions = allowed
+	}
 
-	// add the proxy config key to the request context so the transport function can use it
-	req.Header.Set(proxyConfigHeader, proxy.LocalPrefix)
-	logger.Debug("TokenProxy.Director: rewrote url", "from", originalURL, "to", req.URL)
+	newScope := originalScope
+	newScope.ResourceName = strings.Trim(fmt.Sprintf("%s/%s", proxy.RemotePrefix, strings.TrimPrefix(newScope.ResourceName, proxy.LocalPrefix)), "/")
+	return proxy, &originalScope, &newScope, nil
 }
 
+// RoundTrip handles the token request as rewritten by the Director
 func (tp *TokenProxy) RoundTrip(req *http.Request) (*http.Response, error) {
-	logger.Debug("TokenProxy.RoundTrip: request received", "url", req.URL)
-
-	// Retrieve the proxy config value from the Director
 	proxyLocalPrefix := req.Header.Get(proxyConfigHeader)
-	if proxyLocalPrefix == "" {
+	login := req.Header.Get(proxyLoginHeader) != ""
+	ctx, span := tracer.Start(req.Context(), "TokenProxy.RoundTrip", trace.WithAttributes(
+		attrProxy.String(proxyLocalPrefix),
+		attrScope.String(strings.Join(req.Header.Values(proxyScopeHeader), " ")),
+	))
+	resp, err := tp.roundTrip(req.WithContext(ctx))
+	EndSpan(span, resp, err)
+	RecordResponse(proxyLocalPrefix, "token", resp, err)
+	result := "issued"
+	if err != nil || resp.StatusCode != http.StatusOK {
+		result = "rejected"
+	}
+	if login {
+		// logins aren't for any proxy, so they're counted separately
+		result = "login_" + result
+	}
+	metricTokens.WithLabelValues(proxyLocalPrefix, result).Inc()
+	return resp, err
+}
+
+func (tp *TokenProxy) roundTrip(req *http.Request) (*http.Response, error) {
+	tokenLogger.Debug("TokenProxy.RoundTrip: request received", "url", req.URL)
+
+	// requests the Director couldn't rewrite are answered with its error
+	if regErr := DirectorError(req); regErr != nil {
+		return regErr.Response(req), nil
+	}
+
+	// token requests without a scope are handled locally
+	if req.Header.Get(proxyLoginHeader) != "" {
+		return tp.Login(req)
+	}
+
+	// Retrieve the proxy config values from the Director
+	proxyLocalPrefixes := req.Header.Values(proxyConfigHeader)
+	if len(proxyLocalPrefixes) == 0 {
 		return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to get value in proxyConfigHeader %s", proxyConfigHeader)
 	}
 	req.Header.Del(proxyConfigHeader)
-	proxy, ok := tp.ServerConfig.Proxies[proxyLocalPrefix]
-	if !ok {
-		return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to find key \"%s\" in cfg.Proxies", proxyLocalPrefix)
+	grantedScopes := req.Header.Values(proxyScopeHeader)
+	req.Header.Del(proxyScopeHeader)
+	proxies := []ProxyItem{}
+	for _, proxyLocalPrefix := range proxyLocalPrefixes {
+		proxy, ok := tp.ServerConfig.Proxies[proxyLocalPrefix]
+		if !ok {
+			return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to find key \"%s\" in cfg.Proxies", proxyLocalPrefix)
+		}
+		proxies = append(proxies, proxy)
+	}
+	proxy := proxies[0] // all the proxies share the upstream, see TokenProxy.Director
+
+	// at this point the docker client is requesting a token from us which can
+	// be used to download the image; the client only needs to authenticate to
+	// us if a proxy restricts access to certain users, and must be allowed to
+	// use every proxy the requested scopes belong to
+	identity, err := tp.Auth.Authenticate(req)
+	entry := AccessLogEntryFrom(req.Context())
+	entry.Proxy = proxy.LocalPrefix
+	entry.Identity = identity.String()
+	for _, proxy := range proxies {
+		if err != nil && proxy.RequiresAuth() {
+			tokenLogger.Info("TokenProxy.RoundTrip: client authentication failed", "proxy", proxy.LocalPrefix, "error", err)
+			return BasicChallenge(tp.ServerConfig.ProxyFQDN, err.Error()).Response(req), nil
+		}
+		if !tp.Auth.Authorized(identity, proxy) {
+			tokenLogger.Info("TokenProxy.RoundTrip: client is not authorized for proxy", "proxy", proxy.LocalPrefix, "identity", identity.String())
+			if identity == nil {
+				return BasicChallenge(tp.ServerConfig.ProxyFQDN, "authentication required").Response(req), nil
+			}
+			return NewRegistryError(http.StatusForbidden, errCodeDenied, fmt.Sprintf("%s may not access %s", identity, proxy.LocalPrefix)).Response(req), nil
+		}
+	}
+	trace.SpanFromContext(req.Context()).SetAttributes(attrUpstreamHost.String(proxy.RegistryHost))
+
+	endpoint, err := tp.Endpoints.ForProxy(req.Context(), proxy)
+	if err != nil {
+		tokenLogger.Warn("TokenProxy.RoundTrip: token endpoint of registry is unavailable", "proxy", proxy.LocalPrefix, "registry", proxy.RegistryHost, "error", err)
+		return NewRegistryError(http.StatusServiceUnavailable, errCodeUnavailable, fmt.Sprintf("the token service of %s is unavailable", proxy.RegistryHost)).Response(req), nil
 	}
 
-	// at this point the docker client is requesting a token from us which can be used to download the image
-	// we don't require them to authenticate to us
-	authHeader := req.Header.Get("Authorization")
-	if authHeader != "" {
-		logger.Warn("TokenProxy.RoundTrip: WARNING received an Authorization header from the client", "header", authHeader)
+	var responseData *TokenResponse
+	if endpoint.IsBasic() {
+		// the registry has no token service; the token we issue carries no
+		// upstream token and RegistryProxy sends the proxy's own credentials,
+		// without which every request made with the token would fail
+		if proxy.AuthHeader == "" {
+			tokenLogger.Warn("TokenProxy.RoundTrip: registry uses basic auth but the proxy has no auth configured", "proxy", proxy.LocalPrefix, "registry", proxy.RegistryHost)
+			return NewRegistryError(http.StatusServiceUnavailable, errCodeUnavailable, fmt.Sprintf("%s requires credentials, but none are configured for %s", proxy.RegistryHost, proxy.LocalPrefix)).Response(req), nil
+		}
+		tokenLogger.Debug("TokenProxy.RoundTrip: registry uses basic auth, not requesting an upstream token", "registry", proxy.RegistryHost)
+		responseData = &TokenResponse{IssuedAt: time.Now(), ExpiresIn: basicAuthTokenExpiresIn}
+	} else {
+		responseData, err = tp.UpstreamToken(req, proxy, endpoint)
+		if err != nil {
+			return nil, err
+		}
 	}
+
+	now := time.Now()
+	tokenExpiresAt := responseData.ExpiresAt()
+
+	// issue a token with the real upstream token embedded inside, bound to
+	// the proxy and the scope it was requested for
+	token := paseto.NewToken()
+	token.SetIssuedAt(now)
+	token.SetNotBefore(now)
+	token.SetExpiration(tokenExpiresAt)
+	token.SetString(tokenKeyUpstreamToken, responseData.Token)
+	if identity != nil {
+		token.SetSubject(identity.String())
+	}
+	if err := token.Set(tokenKeyProxies, proxyLocalPrefixes); err != nil {
+		return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to set proxies in token: %s", err)
+	}
+	token.SetString(tokenKeyRegistry, proxy.RegistryHost)
+	if err := token.Set(tokenKeyScopes, grantedScopes); err != nil {
+		return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to set scopes in token: %s", err)
+	}
+	encryptedToken := token.V4Encrypt(tp.SecretKey, nil)
+
+	tokenLogger.Info("TokenProxy.RoundTrip: generated token",
+		"token", Fingerprint(encryptedToken),
+		"upstream_token", Fingerprint(responseData.Token),
+		"subject", identity.String(),
+		"proxies", proxyLocalPrefixes,
+		"registry", proxy.RegistryHost,
+		"scopes", grantedScopes,
+		"expires", tokenExpiresAt)
+
+	return NewJSONResponse(req, http.StatusOK, &TokenResponse{
+		Token:     encryptedToken,
+		ExpiresIn: responseData.ExpiresIn,
+		IssuedAt:  responseData.IssuedAt,
+	})
+}
+
+// UpstreamToken points the token request at the remote token endpoint and
+// returns the upstream token for it; clients asking for the same scope
+// through the same credentials share one cached token
+func (tp *TokenProxy) UpstreamToken(req *http.Request, proxy ProxyItem, endpoint *WWWAuthenticateData) (*TokenResponse, error) {
+	// change the request from a request to our token endpoint to the remote token endpoint
+	u, err := url.Parse(endpoint.Realm) // e.g. https://auth.docker.io/token
+	if err != nil {
+		return nil, fmt.Errorf("TokenProxy.UpstreamToken: unable to parse token endpoint of %s; error: %w", proxy.RegistryHost, err)
+	}
+	queryParams := req.URL.Query()
+	queryParams.Set("service", endpoint.Service) // e.g. registry.docker.io
+	u.RawQuery = queryParams.Encode()
+	originalURL := req.URL.String()
+	req.Host = u.Host
+	req.URL = u
+	tokenLogger.Debug("TokenProxy.UpstreamToken: rewrote url", "from", originalURL, "to", req.URL)
+	AccessLogEntryFrom(req.Context()).UpstreamURL = req.URL.String()
 	req.Header.Set("Authorization", proxy.AuthHeader)
 
 	SetUserAgent(req, tp.ServerConfig.ProxyFQDN)
 	CleanHeaders(req)
 
-	LogRequest("TokenProxy.RoundTrip: about to send the following request to remote token service", req)
+	cacheKey := TokenCacheKey(proxy.RegistryHost, req.URL.Query().Get("service"), strings.Join(req.URL.Query()["scope"], " "), proxy.AuthHeader)
+	responseData, err := tp.Cache.Get(cacheKey, func() (*TokenResponse, error) {
+		// the fetch is shared, so it mustn't be cancelled with one client's request
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), upstreamTokenTimeout)
+		defer cancel()
+		return tp.FetchUpstreamToken(req.WithContext(ctx), proxy)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &responseData, nil
+}
+
+// FetchUpstreamToken sends the (already rewritten) token request to the
+// upstream token service and returns the parsed response
+func (tp *TokenProxy) FetchUpstreamToken(req *http.Request, proxy ProxyItem) (*TokenResponse, error) {
+	ctx, span := tracer.Start(req.Context(), "TokenProxy.FetchUpstreamToken", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrUpstreamHost.String(req.URL.Host)))
+	req = req.WithContext(ctx)
+	InjectTraceContext(req)
+	LogRequest(tokenLogger, "TokenProxy.FetchUpstreamToken: about to send the following request to remote token service", req)
 
 	// make the request to the remote
+	start := time.Now()
 	resp, err := http.DefaultTransport.RoundTrip(req)
-	LogResponse("TokenProxy.RoundTrip: received the following response", resp)
+	metricUpstreamDuration.WithLabelValues(proxy.RegistryHost, "token").Observe(time.Since(start).Seconds())
+	EndSpan(span, resp, err)
+	LogResponse(tokenLogger, "TokenProxy.FetchUpstreamToken: received the following response", resp)
 	if err != nil {
-		return nil, fmt.Errorf("TokenProxy.RoundTrip: upstream request failed with error: %+v", err)
+		return nil, fmt.Errorf("TokenProxy.FetchUpstreamToken: upstream request failed; error: %w", err)
+	}
+	tokenLogger.Debug("TokenProxy.FetchUpstreamToken: DEBUG upstream request completed", "status", resp.StatusCode, "url", req.URL)
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close() //nolint
+		return nil, UpstreamError(resp.StatusCode, "the token service of "+proxy.RegistryHost)
 	}
-	logger.Debug("TokenProxy.RoundTrip: DEBUG upstream request completed", "status", resp.StatusCode, "url", req.URL)
 
 	// process the response body
 	responseData, err := ParseTokenRequestResponse(resp)
 	if err != nil {
-		return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to parse upstream token response; err:%s", err)
+		return nil, fmt.Errorf("TokenProxy.FetchUpstreamToken: unable to parse upstream token response; err:%s", err)
 	}
-	logger.Debug("TokenProxy.RoundTrip: DEBUG parsed response", "data", responseData)
+	tokenLogger.Debug("TokenProxy.FetchUpstreamToken: DEBUG parsed response", "data", responseData)
 
 	if responseData.Token == "" {
-		return nil, fmt.Errorf("TokenProxy.RoundTrip: no token found in parsed response body: %+v", responseData)
+		return nil, fmt.Errorf("TokenProxy.FetchUpstreamToken: no token found in parsed response body: %+v", responseData)
 	}
 
-	now := time.Now()
-
-	// we're going to need these to have a value for the calculation below
+	// we're going to need these to have a value for the expiry calculations
 	if responseData.IssuedAt.IsZero() {
-		responseData.IssuedAt = now
-		logger.Debug("TokenProxy.RoundTrip: DEBUG token from registry had no IssuedAt value (using computed value)", "IssuedAt", responseData.IssuedAt)
+		responseData.IssuedAt = time.Now()
+		tokenLogger.Debug("TokenProxy.FetchUpstreamToken: DEBUG token from registry had no IssuedAt value (using computed value)", "IssuedAt", responseData.IssuedAt)
 	}
 	if responseData.ExpiresIn == 0 {
 		responseData.ExpiresIn = 600
-		logger.Debug("TokenProxy.RoundTrip: DEBUG token from registry had no ExpiresIn value (using computed value)", "seconds", responseData.ExpiresIn)
+		tokenLogger.Debug("TokenProxy.FetchUpstreamToken: DEBUG token from registry had no ExpiresIn value (using computed value)", "seconds", responseData.ExpiresIn)
 	}
 
-	tokenExpiresAt := responseData.IssuedAt.Add(time.Duration(responseData.ExpiresIn) * time.Second)
+	return responseData, nil
+}
+
+// Login handles token requests without a scope, as sent by `docker login`;
+// the client's credentials are checked and a token without any scopes is
+// issued, which lets the client confirm that the login succeeded
+func (tp *TokenProxy) Login(req *http.Request) (*http.Response, error) {
+	identity, err := tp.Auth.Authenticate(req)
+	if err != nil || identity == nil {
+		tokenLogger.Info("TokenProxy.Login: client authentication failed", "error", err)
+		return BasicChallenge(tp.ServerConfig.ProxyFQDN, "authentication required").Response(req), nil
+	}
 
-	// issue a token with the real upstream token embedded inside
+	now := time.Now()
+	expiresIn := uint(loginTokenLifetime / time.Second)
 	token := paseto.NewToken()
 	token.SetIssuedAt(now)
 	token.SetNotBefore(now)
-	token.SetExpiration(tokenExpiresAt)
-	token.SetString(tokenKeyUpstreamToken, responseData.Token)
-	encryptedToken := token.V4Encrypt(tp.SecretKey, nil)
-
-	responseData.Token = encryptedToken
+	token.SetExpiration(now.Add(time.Duration(expiresIn) * time.Second))
+	token.SetSubject(identity.String())
+	tokenLogger.Info("TokenProxy.Login: client logged in", "identity", identity.String())
+	AccessLogEntryFrom(req.Context()).Identity = identity.String()
 
-	logger.Info("TokenProxy.RoundTrip: generted token", "claims", token.ClaimsJSON())
+	return NewJSONResponse(req, http.StatusOK, &TokenResponse{
+		Token:     token.V4Encrypt(tp.SecretKey, nil),
+		ExpiresIn: expiresIn,
+		IssuedAt:  now,
+	})
+}
 
-	if err := ReplaceResponseBody(resp, responseData); err != nil {
-		return nil, fmt.Errorf("TokenProxy.RoundTrip: unable to update the response body: %s", err)
+// ParseToken decrypts and validates the PASETO token in the given
+// "Authorization: Bearer ..." header value
+func ParseToken(secretKey paseto.V4SymmetricKey, authHeader string) (*paseto.Token, error) {
+	if !strings.HasPrefix(authHeader, "Bearer ") {
+		return nil, fmt.Errorf("ParseToken: Authorization header in unknown format")
 	}
-
-	return resp, nil
+	parser := paseto.NewParserForValidNow()
+	return parser.ParseV4Local(secretKey, strings.TrimPrefix(authHeader, "Bearer "), []byte{})
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+func TestBasicUpstream(t *testing.T) {
+	credentials := "Basic " + base64.StdEncoding.EncodeToString([]byte("proxy:secret"))
+	var mu sync.Mutex
+	var received []string // the Authorization headers of upstream requests
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		received = append(received, r.Header.Get("Authorization"))
+		mu.Unlock()
+		if r.Header.Get("Authorization") != credentials {
+			w.Header().Set("Www-Authenticate", `Basic realm="registry"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}")) //nolint
+	}))
+	defer upstream.Close()
+	front := newTestServer(t, "proxies:\n"+
+		"  \"auth/\":\n    registry: "+upstream.URL+"\n    remote: org\n    auth: \""+credentials+"\"\n"+
+		"  \"noauth/\":\n    registry: "+upstream.URL+"\n    remote: org\n")
+
+	t.Run("proxy with auth", func(t *testing.T) {
+		status, token := getToken(t, front, "scope=repository:auth/app:pull", "", "")
+		if status != http.StatusOK || token == "" {
+			t.Fatalf("token status %d", status)
+		}
+		if resp := doRequest(t, front, http.MethodGet, "/v2/auth/app/manifests/latest", token); resp.StatusCode != http.StatusOK {
+			t.Errorf("status %d, want %d", resp.StatusCode, http.StatusOK)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if last := received[len(received)-1]; last != credentials {
+			t.Errorf("upstream received Authorization %q, want the proxy's credentials", last)
+		}
+	})
+
+	t.Run("proxy without auth", func(t *testing.T) {
+		req, _ := http.NewRequest(http.MethodGet, front.URL+"/_token?service=reg.example.com&scope=repository:noauth/app:pull", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close() //nolint
+		regErr := readRegistryError(t, resp)
+		if resp.StatusCode != http.StatusServiceUnavailable || regErr.Code != errCodeUnavailable || !strings.Contains(regErr.Message, "credentials") {
+			t.Errorf("status %d, error %+v; want 503 UNAVAILABLE", resp.StatusCode, regErr)
+		}
+	})
+}
+
+func TestMultiScopeTokens(t *testing.T) {
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	otherUpstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {})
+	front := newTestServer(t, "proxies:\n"+
+		proxyYAML("a/", upstream, "org-a", "actions: [pull, push]")+
+		proxyYAML("b/", upstream, "org-b")+
+		proxyYAML("creds/", upstream, "org-c", `auth: "Basic cHJveHk6c2VjcmV0"`)+
+		proxyYAML("other/", otherUpstream, "org-a"))
+	secretKey, _ := paseto.V4SymmetricKeyFromHex(testSecretKey)
+
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		code     string   // registry error code if the request fails
+		proxies  []string // proxies the token is bound to
+		scopes   []string // scopes granted in the token
+		upstream []string // scopes requested from upstream
+	}{
+		{"single scope", "scope=repository:a/one:pull", http.StatusOK, "",
+			[]string{"a/"}, []string{"repository:a/one:pull"}, []string{"repository:org-a/one:pull"}},
+		{"space separated scopes of one proxy", "scope=repository:a/two:pull+repository:a/three:pull,push", http.StatusOK, "",
+			[]string{"a/"}, []string{"repository:a/two:pull", "repository:a/three:pull,push"}, []string{"repository:org-a/two:pull", "repository:org-a/three:pull,push"}},
+		{"proxies sharing the upstream", "scope=repository:a/four:pull,push&scope=repository:b/four:pull", http.StatusOK, "",
+			[]string{"a/", "b/"}, []string{"repository:a/four:pull,push", "repository:b/four:pull"}, []string{"repository:org-a/four:pull,push", "repository:org-b/four:pull"}},
+		{"disallowed actions are dropped", "scope=repository:b/five:pull,push", http.StatusOK, "",
+			[]string{"b/"}, []string{"repository:b/five:pull"}, []string{"repository:org-b/five:pull"}},
+		{"different credentials", "scope=repository:a/app:pull&scope=repository:creds/app:pull", http.StatusBadRequest, errCodeUnsupported, nil, nil, nil},
+		{"different registries", "scope=repository:a/app:pull+repository:other/app:pull", http.StatusBadRequest, errCodeUnsupported, nil, nil, nil},
+		{"unknown repository", "scope=repository:a/app:pull&scope=repository:unknown/app:pull", http.StatusNotFound, errCodeNameUnknown, nil, nil, nil},
+		{"catalog scope", "scope=repository:a/app:pull&scope=registry:catalog:*", http.StatusBadRequest, errCodeUnsupported, nil, nil, nil},
+		{"malformed scope", "scope=repository:a/app", http.StatusBadRequest, errCodeUnsupported, nil, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokenRequests := len(upstream.Requests("/token"))
+			resp, err := http.Get(front.URL + "/_token?service=reg.example.com&" + tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close() //nolint
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.code != "" {
+				if regErr := readRegistryError(t, resp); regErr.Code != tt.code {
+					t.Errorf("error code %s, want %s", regErr.Code, tt.code)
+				}
+				if len(upstream.Requests("/token")) != tokenRequests {
+					t.Errorf("refused request was sent upstream")
+				}
+				return
+			}
+
+			var tokenResponse TokenResponse
+			json.NewDecoder(resp.Body).Decode(&tokenResponse) //nolint
+			token, err := ParseToken(secretKey, "Bearer "+tokenResponse.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var proxies, scopes []string
+			token.Get(tokenKeyProxies, &proxies) //nolint
+			token.Get(tokenKeyScopes, &scopes)   //nolint
+			if !slices.Equal(proxies, tt.proxies) || !slices.Equal(scopes, tt.scopes) {
+				t.Errorf("token for proxies %v and scopes %v, want %v and %v", proxies, scopes, tt.proxies, tt.scopes)
+			}
+
+			// all the scopes are requested in one upstream token request
+			requests := upstream.Requests("/token")
+			if len(requests) != tokenRequests+1 {
+				t.Fatalf("%d upstream token requests, want 1", len(requests)-tokenRequests)
+			}
+			if got := requests[len(requests)-1].URL.Query()["scope"]; !slices.Equal(got, tt.upstream) {
+				t.Errorf("upstream scopes %v, want %v", got, tt.upstream)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// tokenCacheMargin is how long before their expiry cached upstream tokens
+// stop being handed out, so clients don't receive tokens which expire while
+// they're being used
+const tokenCacheMargin = 30 * time.Second
+
+// TokenCache caches the responses of upstream token services so that many
+// clients requesting the same scope share one upstream token
+type TokenCache struct {
+	mu      sync.Mutex
+	entries map[string]TokenResponse
+	group   singleflight.Group
+}
+
+// NewTokenCache returns an empty TokenCache
+func NewTokenCache() *TokenCache {
+	return &TokenCache{
+		entries: map[string]TokenResponse{},
+	}
+}
+
+// TokenCacheKey returns the cache key for an upstream token request; the
+// credential is hashed so it isn't kept around in memory in plain text
+func TokenCacheKey(registryHost, service, scope, credential string) string {
+	credentialHash := sha256.Sum256([]byte(credential))
+	return registryHost + "\x00" + service + "\x00" + scope + "\x00" + hex.EncodeToString(credentialHash[:])
+}
+
+// Get returns the cached token response for the given key, or calls fetch
+// to get a fresh one; concurrent calls for the same key share a single
+// fetch. The fetched response must have its IssuedAt and ExpiresIn set.
+func (tc *TokenCache) Get(key string, fetch func() (*TokenResponse, error)) (TokenResponse, error) {
+	if cached, ok := tc.lookup(key); ok {
+		metricTokenCacheHits.Inc()
+		tokenLogger.Debug("TokenCache.Get: cache hit")
+		return cached, nil
+	}
+
+	fetched := false
+	result, err, _ := tc.group.Do(key, func() (any, error) {
+		fetched = true
+		metricTokenCacheMisses.Inc()
+		tokenLogger.Debug("TokenCache.Get: cache miss")
+		response, err := fetch()
+		if err != nil {
+			return nil, err
+		}
+		tc.store(key, *response)
+		return *response, nil
+	})
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if !fetched {
+		// another request fetched the token for us
+		metricTokenCacheHits.Inc()
+	}
+	return result.(TokenResponse), nil
+}
+
+// lookup returns the cached token response for the given key if it is
+// still usable
+func (tc *TokenCache) lookup(key string) (TokenResponse, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	cached, ok := tc.entries[key]
+	if !ok {
+		return TokenResponse{}, false
+	}
+	if time.Now().After(cached.ExpiresAt().Add(-tokenCacheMargin)) {
+		delete(tc.entries, key)
+		metricTokenCacheEvictions.Inc()
+		return TokenResponse{}, false
+	}
+	return cached, true
+}
+
+// store adds the token response to the cache, and drops any expired entries
+func (tc *TokenCache) store(key string, response TokenResponse) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	now := time.Now()
+	for k, cached := range tc.entries {
+		if now.After(cached.ExpiresAt().Add(-tokenCacheMargin)) {
+			delete(tc.entries, k)
+			metricTokenCacheEvictions.Inc()
+		}
+	}
+	if now.After(response.ExpiresAt().Add(-tokenCacheMargin)) {
+		// too short-lived to be worth caching
+		return
+	}
+	tc.entries[key] = response
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingFetch returns a fetch function for TokenCache.Get which counts its
+// calls and returns tokens with the given lifetime
+func countingFetch(calls *atomic.Int32, expiresIn uint) func() (*TokenResponse, error) {
+	return func() (*TokenResponse, error) {
+		n := calls.Add(1)
+		return &TokenResponse{Token: fmt.Sprintf("token-%d", n), ExpiresIn: expiresIn, IssuedAt: time.Now()}, nil
+	}
+}
+
+func TestTokenCacheHitsAndMisses(t *testing.T) {
+	cache := NewTokenCache()
+	var calls atomic.Int32
+	hits, misses := testutil.ToFloat64(metricTokenCacheHits), testutil.ToFloat64(metricTokenCacheMisses)
+
+	for _, key := range []string{"a", "a", "b", "a"} {
+		if _, err := cache.Get(key, countingFetch(&calls, 300)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d fetches, want 2", calls.Load())
+	}
+	if got := testutil.ToFloat64(metricTokenCacheHits) - hits; got != 2 {
+		t.Errorf("%v hits, want 2", got)
+	}
+	if got := testutil.ToFloat64(metricTokenCacheMisses) - misses; got != 2 {
+		t.Errorf("%v misses, want 2", got)
+	}
+
+	// failed fetches aren't cached
+	if _, err := cache.Get("c", func() (*TokenResponse, error) { return nil, errors.New("boom") }); err == nil {
+		t.Error("fetch error was swallowed")
+	}
+	if response, err := cache.Get("c", countingFetch(&calls, 300)); err != nil || response.Token != "token-3" {
+		t.Errorf("got %+v, %v after a failed fetch", response, err)
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	cache := NewTokenCache()
+	var calls atomic.Int32
+
+	// tokens expiring within tokenCacheMargin aren't cached
+	shortLived := uint(tokenCacheMargin/time.Second) - 1
+	cache.Get("short", countingFetch(&calls, shortLived)) //nolint
+	cache.Get("short", countingFetch(&calls, shortLived)) //nolint
+	if calls.Load() != 2 {
+		t.Errorf("%d fetches of a short-lived token, want 2", calls.Load())
+	}
+
+	// cached tokens are dropped once they get close to their expiry
+	evictions := testutil.ToFloat64(metricTokenCacheEvictions)
+	cache.entries["old"] = TokenResponse{Token: "old", ExpiresIn: 300, IssuedAt: time.Now().Add(-300*time.Second + tokenCacheMargin/2)}
+	if response, _ := cache.Get("old", countingFetch(&calls, 300)); response.Token == "old" {
+		t.Error("token about to expire was handed out")
+	}
+	if calls.Load() != 3 {
+		t.Errorf("%d fetches, want 3", calls.Load())
+	}
+	if got := testutil.ToFloat64(metricTokenCacheEvictions) - evictions; got != 1 {
+		t.Errorf("%v evictions, want 1", got)
+	}
+}
+
+func TestTokenCacheCollapsesRequests(t *testing.T) {
+	cache := NewTokenCache()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	fetch := func() (*TokenResponse, error) {
+		<-release
+		return countingFetch(&calls, 300)()
+	}
+
+	var wg sync.WaitGroup
+	tokens := make([]string, 10)
+	for i := range tokens {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, _ := cache.Get("key", fetch)
+			tokens[i] = response.Token
+		}()
+	}
+	time.Sleep(50 * time.Millisecond) // let the requests pile up
+	close(release)
+	wg.Wait()
+
+	if calls.Load() != 1 {
+		t.Errorf("%d fetches, want 1", calls.Load())
+	}
+	for i, token := range tokens {
+		if token != "token-1" {
+			t.Errorf("request %d got %q", i, token)
+		}
+	}
+}
+
+// the shared upstream token request mustn't fail because the client which
+// started it went away
+func TestUpstreamTokenSurvivesCancelledLeader(t *testing.T) {
+	var tokenRequests atomic.Int32
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	var upstream *httptest.Server
+	upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/token" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="upstream"`, upstream.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		tokenRequests.Add(1)
+		received <- struct{}{}
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"token":"upstream-token","expires_in":300}`) //nolint
+	}))
+	defer upstream.Close()
+	front := newTestServer(t, "proxies:\n  \"a/\":\n    registry: "+upstream.URL+"\n    remote: org\n")
+	url := front.URL + "/_token?service=reg.example.com&scope=repository:a/app:pull"
+
+	// the leader's request is cancelled while the upstream request is running
+	ctx, cancel := context.WithCancel(context.Background())
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if resp, err := http.DefaultClient.Do(req); err == nil {
+			resp.Body.Close() //nolint
+		}
+	}()
+	<-received
+
+	waiterStatus := make(chan int)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			waiterStatus <- 0
+			return
+		}
+		resp.Body.Close() //nolint
+		waiterStatus <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond) // let the waiter join the upstream request
+	cancel()
+	<-leaderDone
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if status := <-waiterStatus; status != http.StatusOK {
+		t.Errorf("waiter got status %d, want %d", status, http.StatusOK)
+	}
+	if tokenRequests.Load() != 1 {
+		t.Errorf("%d upstream token requests, want 1", tokenRequests.Load())
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// attribute keys used on our spans
+const (
+	attrProxy        = attribute.Key("registryproxy.proxy")         // the LocalPrefix of the ProxyItem
+	attrUpstreamHost = attribute.Key("registryproxy.upstream_host") // the RegistryHost of the ProxyItem
+	attrScope        = attribute.Key("registryproxy.scope")         // a token resource scope
+	attrDigest       = attribute.Key("registryproxy.digest")        // a manifest or blob digest
+	attrEndpoint     = attribute.Key("registryproxy.endpoint")      // the registry endpoint kind, see EndpointKind
+	attrStatusCode   = attribute.Key("http.response.status_code")
+)
+
+var tracer = otel.Tracer("registryproxy")
+
+// TracingConfig configures the export of OpenTelemetry traces
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint" json:"endpoint"`         // OTLP/HTTP collector address, e.g. "localhost:4318"; tracing is disabled if empty
+	Insecure    bool    `yaml:"insecure" json:"insecure"`         // use plain HTTP to talk to the collector
+	SampleRatio float64 `yaml:"sample_ratio" json:"sample_ratio"` // fraction of new traces to sample; defaults to 1
+}
+
+// SetupTracing installs the W3C trace context propagator (but not baggage,
+// which would pass whatever clients send on to the upstream registries) and,
+// if an endpoint is configured, a tracer provider exporting spans over
+// OTLP/HTTP. The returned function flushes and stops the exporter.
+func SetupTracing(cfg TracingConfig) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if cfg.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("SetupTracing: unable to create OTLP exporter; error: %w", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "registryproxy"),
+		attribute.String("service.version", version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("SetupTracing: unable to create resource; error: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	logger.Info("exporting traces", "endpoint", cfg.Endpoint, "sample_ratio", cfg.SampleRatio)
+	return provider.Shutdown, nil
+}
+
+// TraceRequests is a middleware which continues the trace in the request's
+// traceparent header (if any) and wraps the request in a server span
+func TraceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the client's baggage is meant for us, not for the upstream registries
+		req.Header.Del("Baggage")
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+EndpointKind(req.URL.Path),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("url.path", req.URL.Path),
+			))
+		defer span.End()
+		next.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+// InjectTraceContext adds the traceparent header for the span in the
+// request's context to the request, so upstream services can continue it
+func InjectTraceContext(req *http.Request) {
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+}
+
+// EndSpan records the outcome of a RoundTrip function on the span and ends it
+func EndSpan(span trace.Span, resp *http.Response, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	} else if resp != nil {
+		span.SetAttributes(attrStatusCode.Int(resp.StatusCode))
+		if resp.StatusCode >= 500 {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	span.End()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorder     *tracetest.SpanRecorder
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans installs a tracer provider which records every span; it can
+// only be installed once per process, as tracer only delegates to the first
+// provider set
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	spanRecorderOnce.Do(func() {
+		if _, err := SetupTracing(TracingConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// tracedSpans waits for the server span of the given trace to end and
+// returns the spans of the trace by name
+func tracedSpans(t *testing.T, recorder *tracetest.SpanRecorder, traceID trace.TraceID, serverSpan string) map[string]sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		spans := map[string]sdktrace.ReadOnlySpan{}
+		for _, span := range recorder.Ended() {
+			if span.SpanContext().TraceID() == traceID {
+				spans[span.Name()] = span
+			}
+		}
+		if _, ok := spans[serverSpan]; ok || time.Now().After(deadline) {
+			return spans
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// spanAttributes returns the attributes of the span as strings
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]string {
+	attributes := map[attribute.Key]string{}
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value.Emit()
+	}
+	return attributes
+}
+
+// upstreamParent returns the trace and parent span id in the traceparent
+// header of an upstream request
+func upstreamParent(t *testing.T, req *http.Request) (trace.TraceID, trace.SpanID) {
+	t.Helper()
+	parts := strings.Split(req.Header.Get("Traceparent"), "-")
+	if len(parts) != 4 {
+		t.Fatalf("upstream request has traceparent %q", req.Header.Get("Traceparent"))
+	}
+	traceID, _ := trace.TraceIDFromHex(parts[1])
+	spanID, _ := trace.SpanIDFromHex(parts[2])
+	return traceID, spanID
+}
+
+func TestTracing(t *testing.T) {
+	recorder := recordSpans(t)
+	digest := "sha256:" + strings.Repeat("ab", 32)
+	upstream := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Write([]byte("{}")) //nolint
+	})
+	path := writeTestFile(t, "config.yaml", "secret_key: "+testSecretKey+"\nproxy_fqdn: reg.example.com\nproxies:\n"+proxyYAML("a/", upstream, "org-a"))
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front := httptest.NewServer(TraceRequests(server))
+	defer front.Close()
+	registryHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	// requests continue the trace of the client
+	traced := func(url, authorization, traceID string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+		req.Header.Set("Baggage", "user.id=alice")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close() //nolint
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status %d", resp.StatusCode)
+		}
+	}
+
+	t.Run("token request", func(t *testing.T) {
+		traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+		traced(front.URL+"/_token?service=reg.example.com&scope=repository:a/app:pull", "", traceID.String())
+
+		spans := tracedSpans(t, recorder, traceID, "GET other")
+		for _, name := range []string{"GET other", "TokenProxy.Director", "TokenProxy.RoundTrip", "TokenProxy.FetchUpstreamToken"} {
+			if _, ok := spans[name]; !ok {
+				t.Errorf("no %s span, got %v", name, spans)
+			}
+		}
+		if attributes := spanAttributes(spans["TokenProxy.RoundTrip"]); attributes[attrProxy] != "a/" || attributes[attrScope] != "repository:a/app:pull" {
+			t.Errorf("TokenProxy.RoundTrip attributes %v", attributes)
+		}
+		if attributes := spanAttributes(spans["TokenProxy.FetchUpstreamToken"]); attributes[attrUpstreamHost] != registryHost || attributes[attrStatusCode] != "200" {
+			t.Errorf("TokenProxy.FetchUpstreamToken attributes %v", attributes)
+		}
+
+		requests := upstream.Requests("/token")
+		upstreamTrace, parent := upstreamParent(t, requests[len(requests)-1])
+		if upstreamTrace != traceID || parent != spans["TokenProxy.FetchUpstreamToken"].SpanContext().SpanID() {
+			t.Errorf("upstream token request continues %s/%s, want the FetchUpstreamToken span", upstreamTrace, parent)
+		}
+		if baggage := requests[len(requests)-1].Header.Get("Baggage"); baggage != "" {
+			t.Errorf("upstream token request has the client's baggage %q", baggage)
+		}
+	})
+
+	t.Run("registry request", func(t *testing.T) {
+		_, token := getToken(t, front, "scope=repository:a/app:pull", "", "")
+		traceID, _ := trace.TraceIDFromHex("5bf92f3577b34da6a3ce929d0e0e4736")
+		traced(front.URL+"/v2/a/app/manifests/"+digest, "Bearer "+token, traceID.String())
+
+		spans := tracedSpans(t, recorder, traceID, "GET manifest")
+		for _, name := range []string{"GET manifest", "RegistryProxy.RoundTrip", "RegistryProxy.Upstream"} {
+			if _, ok := spans[name]; !ok {
+				t.Errorf("no %s span, got %v", name, spans)
+			}
+		}
+		want := map[attribute.Key]string{
+			attrProxy:        "a/",
+			attrUpstreamHost: registryHost,
+			attrEndpoint:     "manifest",
+			attrDigest:       digest,
+			attrStatusCode:   "200",
+		}
+		attributes := spanAttributes(spans["RegistryProxy.RoundTrip"])
+		for key, value := range want {
+			if attributes[key] != value {
+				t.Errorf("RegistryProxy.RoundTrip attribute %s is %q, want %q", key, attributes[key], value)
+			}
+		}
+		if server := spans["GET manifest"]; server.Parent().TraceID() != traceID || server.SpanKind() != trace.SpanKindServer {
+			t.Errorf("server span doesn't continue the client's trace")
+		}
+
+		requests := upstream.Requests("/v2/org-a/app/manifests/" + digest)
+		upstreamTrace, parent := upstreamParent(t, requests[len(requests)-1])
+		if upstreamTrace != traceID || parent != spans["RegistryProxy.Upstream"].SpanContext().SpanID() {
+			t.Errorf("upstream request continues %s/%s, want the RegistryProxy.Upstream span", upstreamTrace, parent)
+		}
+		if baggage := requests[len(requests)-1].Header.Get("Baggage"); baggage != "" {
+			t.Errorf("upstream request has the client's baggage %q", baggage)
+		}
+	})
+}
@@ -5,10 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log/slog"
 	"net/http"
-	"net/http/httputil"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -59,6 +58,11 @@ type TokenResponse struct {
 	Error     string    `json:"error"`      // just in case
 }
 
+// ExpiresAt returns the time at which the token expires
+func (tr TokenResponse) ExpiresAt() time.Time {
+	return tr.IssuedAt.Add(time.Duration(tr.ExpiresIn) * time.Second)
+}
+
 // ParseTokenRequestResponse takes an *http.Response, checks if the content type is application/json,
 // and returns a map[string]string parsed from the JSON body
 func ParseTokenRequestResponse(resp *http.Response) (*TokenResponse, error) {
@@ -78,92 +82,49 @@ func ParseTokenRequestResponse(resp *http.Response) (*TokenResponse, error) {
 	// Unmarshal JSON data into a map
 	var response TokenResponse
 	if err := json.Unmarshal(body, &response); err != nil {
-		return nil, fmt.Errorf("parseTokenRequestResponse: failed to unmarshal JSON: %w, body: %s", err, body)
+		return nil, fmt.Errorf("parseTokenRequestResponse: failed to unmarshal JSON: %w, body: %s", err, RedactBody(body))
 	}
 
 	return &response, nil
 }
 
-// ReplaceResponseBody takes an *http.Response and a map[string]string, then replaces
-// the response's body with a JSON-encoded version of the map.
-func ReplaceResponseBody(resp *http.Response, data *TokenResponse) error {
-	// Marshal the map into JSON
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
-	}
-
-	// Replace the body with the new JSON data
-	resp.Body = io.NopCloser(bytes.NewReader(jsonData))
-
-	// update the Content-Length header
-	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-
-	// Set the Content-Type header to application/json
-	resp.Header.Set("Content-Type", "application/json")
-
-	return nil
-}
-
-type WWWAuthenticateData struct {
-	Realm   string
-	Service string
-	Scope   string
-	Error   string
-}
-
-// String returns a value useable as Www-Authenticate header
-func (authFields WWWAuthenticateData) String() string {
-	return fmt.Sprintf(`Bearer realm="%s",service="%s",scope="%s"`, authFields.Realm, authFields.Service, authFields.Scope)
-}
-
-// ParseWWWAuthenticate parses the given header contents and returns a struct
-// containing the parsed values; returns a WWWAuthFields struct and a boolean OK value
-func ParseWWWAuthenticate(headerValue string) (WWWAuthenticateData, bool) {
-	fieldRegex := regexp.MustCompile(`(realm|service|scope|error)="([^"]+)"`)
-	matches := fieldRegex.FindAllStringSubmatch(headerValue, -1)
-
-	result := WWWAuthenticateData{}
-	ok := false
-
-	for _, match := range matches {
-		if len(match) == 3 {
-			ok = true
-			switch match[1] {
-			case "realm":
-				result.Realm = match[2]
-			case "service":
-				result.Service = match[2]
-			case "scope":
-				result.Scope = match[2]
-			case "error":
-				result.Error = match[2]
-			}
-		}
+// NewResponse returns an *http.Response to req with the given status and
+// body of the given content type and size, suitable for returning from a
+// RoundTrip function
+func NewResponse(req *http.Request, status int, contentType string, body io.ReadCloser, size int64) *http.Response {
+	resp := &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        make(http.Header),
+		Body:          body,
+		ContentLength: size,
+		Request:       req,
 	}
-
-	return result, ok
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+	return resp
 }
 
-// LogRequest logs the contents of an http.Request object
-func LogRequest(preamble string, req *http.Request) {
-	dump, err := httputil.DumpRequest(req, true)
-	if err != nil {
-		logger.Debug("logRequest: failed httputil.DumpRequest", "error", err)
-		return
-	}
-	logger.Debug(preamble, "request", dump)
-
+// ReplayBody returns a body which yields the prefix already read from body
+// followed by the rest of body, and closes body when closed
+func ReplayBody(prefix []byte, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(prefix), body), body}
 }
 
-// LogResponse logs the contents of an http.Response object
-func LogResponse(preamble string, resp *http.Response) {
-	dump, err := httputil.DumpResponse(resp, true)
+// NewJSONResponse returns an *http.Response with the given status and the
+// JSON-encoded data as its body
+func NewJSONResponse(req *http.Request, status int, data any) (*http.Response, error) {
+	jsonData, err := json.Marshal(data)
 	if err != nil {
-		logger.Debug("logResponse: failed httputil.DumpResponse", "error", err)
-		return
+		return nil, fmt.Errorf("failed to marshal data: %w", err)
 	}
-	logger.Debug(preamble, "response", dump)
+	return NewResponse(req, status, "application/json", io.NopCloser(bytes.NewReader(jsonData)), int64(len(jsonData))), nil
 }
 
 // CleanHeaders removes all headers from the request that start with "X-"
@@ -184,17 +145,29 @@ func SlashJoin(a, b string, trim_exterior bool) string {
 	return result
 }
 
-// setLogLevel sets the log level
-func setLogLevel(level string) {
-	switch strings.ToUpper(level) {
-	case "INFO":
-		logLevel.Set(slog.LevelInfo)
-	case "WARN":
-		logLevel.Set(slog.LevelWarn)
-	case "ERROR":
-		logLevel.Set(slog.LevelError)
-	// case "DEBUG":
-	default:
-		logLevel.Set(slog.LevelDebug)
+// ParseSize parses a size like "512MB" or "10GiB" into a number of bytes;
+// a value without a unit is a number of bytes
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"B", 1},
+	}
+	size = strings.TrimSpace(size)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(size, unit.suffix); ok {
+			size = strings.TrimSpace(number)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("ParseSize: invalid size \"%s\"", size)
 	}
+	return value * multiplier, nil
 }
@@ -0,0 +1,279 @@
+// Parsing and rendering of WWW-Authenticate headers
+//
+// The following grammar is reproduced from RFC 7235 section 4.1 and 2.1,
+// RFC 7230 section 3.2.6 (token, quoted-string) and RFC 6750 section 3:
+//
+// WWW-Authenticate = 1#challenge
+// challenge        = auth-scheme [ 1*SP ( token68 / #auth-param ) ]
+// auth-scheme      = token
+// auth-param       = token BWS "=" BWS ( token / quoted-string )
+// token68          = 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"="
+// quoted-string    = DQUOTE *( qdtext / quoted-pair ) DQUOTE
+// quoted-pair      = "\" ( HTAB / SP / VCHAR / obs-text )
+//
+// Bearer challenges (RFC 6750) carry the realm, scope, error and
+// error_description params; docker registries add service, and their scope
+// may hold several space separated resource scopes.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// WWWAuthenticateData is one challenge of a WWW-Authenticate header
+type WWWAuthenticateData struct {
+	Scheme  string // e.g. "Bearer" or "Basic"; rendered as "Bearer" if empty
+	Realm   string
+	Service string
+	Scope   string            // one or more space separated resource scopes
+	Error   string            // e.g. "invalid_token" or "insufficient_scope"
+	Params  map[string]string // any other auth-params, keyed by lowercase name
+	Token68 string            // set instead of params by some schemes
+}
+
+// String returns a value useable as Www-Authenticate header; empty params
+// are left out
+func (authFields WWWAuthenticateData) String() string {
+	scheme := authFields.Scheme
+	if scheme == "" {
+		scheme = "Bearer"
+	}
+	if authFields.Token68 != "" {
+		return scheme + " " + authFields.Token68
+	}
+
+	params := []string{}
+	add := func(name, value string) {
+		if value != "" {
+			params = append(params, name+"="+quoteString(value))
+		}
+	}
+	add("realm", authFields.Realm)
+	add("service", authFields.Service)
+	add("scope", authFields.Scope)
+	add("error", authFields.Error)
+	names := make([]string, 0, len(authFields.Params))
+	for name := range authFields.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		add(name, authFields.Params[name])
+	}
+	if len(params) == 0 {
+		return scheme
+	}
+	return scheme + " " + strings.Join(params, ",")
+}
+
+// IsBasic returns true if the header asks for basic auth, i.e. the registry
+// doesn't use a token service
+func (authFields WWWAuthenticateData) IsBasic() bool {
+	return strings.EqualFold(authFields.Scheme, "Basic")
+}
+
+// IsBearer returns true if the header asks for a bearer token
+func (authFields WWWAuthenticateData) IsBearer() bool {
+	return strings.EqualFold(authFields.Scheme, "Bearer")
+}
+
+// ParseWWWAuthenticate parses the given WWW-Authenticate header values and
+// returns the challenge a registry client should answer: the first Bearer
+// challenge, otherwise the first Basic one; returns the challenge and a
+// boolean OK value
+func ParseWWWAuthenticate(headerValues ...string) (WWWAuthenticateData, bool) {
+	var basic *WWWAuthenticateData
+	for _, headerValue := range headerValues {
+		challenges, err := ParseChallenges(headerValue)
+		if err != nil {
+			continue
+		}
+		for i, challenge := range challenges {
+			switch {
+			case challenge.IsBearer():
+				return challenge, true
+			case challenge.IsBasic() && basic == nil:
+				basic = &challenges[i]
+			}
+		}
+	}
+	if basic == nil {
+		return WWWAuthenticateData{}, false
+	}
+	return *basic, true
+}
+
+// ParseChallenges parses all the challenges in a WWW-Authenticate header value
+func ParseChallenges(headerValue string) ([]WWWAuthenticateData, error) {
+	p := &challengeParser{s: headerValue}
+	challenges := []WWWAuthenticateData{}
+	for {
+		p.skipListSeparators()
+		if p.done() {
+			break
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, fmt.Errorf("ParseChallenges: expected an auth scheme at offset %d; header: %s", p.i, headerValue)
+		}
+		challenge := WWWAuthenticateData{Scheme: scheme}
+		if p.skipSpace() && !p.done() && p.peek() != ',' {
+			if token68, ok := p.token68(); ok {
+				challenge.Token68 = token68
+			} else if err := p.params(&challenge); err != nil {
+				return nil, fmt.Errorf("ParseChallenges: %w; header: %s", err, headerValue)
+			}
+		}
+		challenges = append(challenges, challenge)
+	}
+	if len(challenges) == 0 {
+		return nil, fmt.Errorf("ParseChallenges: no challenge found; header: %s", headerValue)
+	}
+	return challenges, nil
+}
+
+// challengeParser holds the state of ParseChallenges
+type challengeParser struct {
+	s string
+	i int
+}
+
+func (p *challengeParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *challengeParser) peek() byte {
+	return p.s[p.i]
+}
+
+// skipSpace skips optional whitespace and returns true if there was any
+func (p *challengeParser) skipSpace() bool {
+	start := p.i
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.i++
+	}
+	return p.i > start
+}
+
+// skipListSeparators skips whitespace and the commas between list elements
+func (p *challengeParser) skipListSeparators() {
+	for !p.done() && (p.peek() == ' ' || p.peek() == '\t' || p.peek() == ',') {
+		p.i++
+	}
+}
+
+// token reads a token, returning an empty string if there is none
+func (p *challengeParser) token() string {
+	start := p.i
+	for !p.done() && isTokenChar(p.peek()) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// token68 reads a token68 if one follows, i.e. it's the whole challenge
+func (p *challengeParser) token68() (string, bool) {
+	start := p.i
+	for !p.done() && (isAlphaNum(p.peek()) || strings.IndexByte("-._~+/", p.peek()) >= 0) {
+		p.i++
+	}
+	for p.i > start && !p.done() && p.peek() == '=' {
+		p.i++
+	}
+	end := p.i
+	p.skipSpace()
+	if end == start || !(p.done() || p.peek() == ',') {
+		p.i = start
+		return "", false
+	}
+	return p.s[start:end], true
+}
+
+// params reads the auth-params of a challenge; it stops at the start of the
+// next challenge
+func (p *challengeParser) params(challenge *WWWAuthenticateData) error {
+	for {
+		start := p.i
+		p.skipSpace()
+		name := strings.ToLower(p.token())
+		p.skipSpace()
+		if name == "" || p.done() || p.peek() != '=' {
+			// not a param, so the next challenge starts here
+			p.i = start
+			return nil
+		}
+		p.i++ // the "="
+		p.skipSpace()
+
+		var value string
+		if !p.done() && p.peek() == '"' {
+			var err error
+			if value, err = p.quotedString(); err != nil {
+				return err
+			}
+		} else if value = p.token(); value == "" {
+			return fmt.Errorf("expected a value for param %s at offset %d", name, p.i)
+		}
+		switch name {
+		case "realm":
+			challenge.Realm = value
+		case "service":
+			challenge.Service = value
+		case "scope":
+			challenge.Scope = value
+		case "error":
+			challenge.Error = value
+		default:
+			if challenge.Params == nil {
+				challenge.Params = map[string]string{}
+			}
+			challenge.Params[name] = value
+		}
+
+		p.skipSpace()
+		if p.done() || p.peek() != ',' {
+			return nil
+		}
+		p.i++ // the ","
+		p.skipListSeparators()
+	}
+}
+
+// quotedString reads a quoted-string and returns its unescaped contents
+func (p *challengeParser) quotedString() (string, error) {
+	start := p.i
+	p.i++ // the opening quote
+	var value strings.Builder
+	for !p.done() {
+		c := p.peek()
+		p.i++
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if p.done() {
+				return "", fmt.Errorf("unterminated quoted-pair at offset %d", p.i)
+			}
+			value.WriteByte(p.peek())
+			p.i++
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated quoted-string starting at offset %d", start)
+}
+
+// quoteString renders the value as a quoted-string
+func quoteString(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func isAlphaNum(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+func isTokenChar(c byte) bool {
+	return isAlphaNum(c) || strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseChallenges(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []WWWAuthenticateData // nil if parsing must fail
+	}{
+		{"docker hub", `Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/nginx:pull"`,
+			[]WWWAuthenticateData{{Scheme: "Bearer", Realm: "https://auth.docker.io/token", Service: "registry.docker.io", Scope: "repository:library/nginx:pull"}}},
+		{"scheme only", `Basic`, []WWWAuthenticateData{{Scheme: "Basic"}}},
+		{"several challenges", `Basic realm="registry", Bearer realm="https://auth.example.com/token",scope="repository:a:pull repository:b:push"`,
+			[]WWWAuthenticateData{
+				{Scheme: "Basic", Realm: "registry"},
+				{Scheme: "Bearer", Realm: "https://auth.example.com/token", Scope: "repository:a:pull repository:b:push"},
+			}},
+		{"escaped quotes", `Bearer realm="a \"quoted\" realm",service="back\\slash"`,
+			[]WWWAuthenticateData{{Scheme: "Bearer", Realm: `a "quoted" realm`, Service: `back\slash`}}},
+		{"comma in a quoted value", `Bearer realm="a,b",scope="repository:x:pull,push"`,
+			[]WWWAuthenticateData{{Scheme: "Bearer", Realm: "a,b", Scope: "repository:x:pull,push"}}},
+		{"unquoted values", `Bearer service=registry.example.com, error=invalid_token`,
+			[]WWWAuthenticateData{{Scheme: "Bearer", Service: "registry.example.com", Error: "invalid_token"}}},
+		{"whitespace around equals", "Bearer realm = \"r\" ,\tservice=\"s\"",
+			[]WWWAuthenticateData{{Scheme: "Bearer", Realm: "r", Service: "s"}}},
+		{"case insensitive param names", `Bearer Realm="r",SCOPE="s"`,
+			[]WWWAuthenticateData{{Scheme: "Bearer", Realm: "r", Scope: "s"}}},
+		{"other params", `Bearer realm="r",error="insufficient_scope",error_description="pull access denied"`,
+			[]WWWAuthenticateData{{Scheme: "Bearer", Realm: "r", Error: "insufficient_scope", Params: map[string]string{"error_description": "pull access denied"}}}},
+		{"token68", `Negotiate YIIBhwYGKwYBBQUCoIIBezCC==`, []WWWAuthenticateData{{Scheme: "Negotiate", Token68: "YIIBhwYGKwYBBQUCoIIBezCC=="}}},
+		{"token68 followed by a challenge", `Negotiate abc=, Basic realm="r"`,
+			[]WWWAuthenticateData{{Scheme: "Negotiate", Token68: "abc="}, {Scheme: "Basic", Realm: "r"}}},
+		{"empty list elements", `, Basic realm="r",, `, []WWWAuthenticateData{{Scheme: "Basic", Realm: "r"}}},
+		{"empty", ``, nil},
+		{"unterminated quoted-string", `Bearer realm="https://auth.example.com/token`, nil},
+		{"unterminated quoted-pair", `Bearer realm="abc\`, nil},
+		{"missing value", `Bearer realm=,service="s"`, nil},
+		{"no scheme", `="r"`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseChallenges(tt.header)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("ParseChallenges(%q) = %+v, want an error", tt.header, got)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseChallenges(%q) = %+v, %v; want %+v", tt.header, got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseWWWAuthenticate(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   WWWAuthenticateData
+		ok     bool
+	}{
+		{"bearer preferred over basic", []string{`Basic realm="b", Bearer realm="t"`}, WWWAuthenticateData{Scheme: "Bearer", Realm: "t"}, true},
+		{"bearer in a later header", []string{`Basic realm="b"`, `Bearer realm="t"`}, WWWAuthenticateData{Scheme: "Bearer", Realm: "t"}, true},
+		{"first basic", []string{`Negotiate abc`, `Basic realm="b1"`, `Basic realm="b2"`}, WWWAuthenticateData{Scheme: "Basic", Realm: "b1"}, true},
+		{"lowercase scheme", []string{`bearer realm="t"`}, WWWAuthenticateData{Scheme: "bearer", Realm: "t"}, true},
+		{"unparsable header skipped", []string{`Bearer realm="t`, `Basic realm="b"`}, WWWAuthenticateData{Scheme: "Basic", Realm: "b"}, true},
+		{"no usable challenge", []string{`Negotiate abc`}, WWWAuthenticateData{}, false},
+		{"no headers", nil, WWWAuthenticateData{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseWWWAuthenticate(tt.values...)
+			if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseWWWAuthenticate(%q) = %+v, %v; want %+v, %v", tt.values, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWWWAuthenticateString(t *testing.T) {
+	tests := []struct {
+		name      string
+		challenge WWWAuthenticateData
+		want      string
+	}{
+		{"bearer", WWWAuthenticateData{Realm: "https://reg.example.com/_token", Service: "reg.example.com", Scope: "repository:a/b:pull"},
+			`Bearer realm="https://reg.example.com/_token",service="reg.example.com",scope="repository:a/b:pull"`},
+		{"error", WWWAuthenticateData{Scheme: "Bearer", Realm: "r", Error: "invalid_token"}, `Bearer realm="r",error="invalid_token"`},
+		{"basic", WWWAuthenticateData{Scheme: "Basic", Realm: "reg.example.com"}, `Basic realm="reg.example.com"`},
+		{"scheme only", WWWAuthenticateData{Scheme: "Basic"}, `Basic`},
+		{"quoting", WWWAuthenticateData{Realm: `a "b" \c`}, `Bearer realm="a \"b\" \\c"`},
+		{"other params sorted", WWWAuthenticateData{Realm: "r", Params: map[string]string{"z": "1", "a": "2"}}, `Bearer realm="r",a="2",z="1"`},
+		{"token68", WWWAuthenticateData{Scheme: "Negotiate", Token68: "abc=="}, `Negotiate abc==`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.challenge.String()
+			if got != tt.want {
+				t.Errorf("String() = %s, want %s", got, tt.want)
+			}
+
+			// rendered challenges parse back into the same challenge
+			parsed, err := ParseChallenges(got)
+			want := tt.challenge
+			if want.Scheme == "" {
+				want.Scheme = "Bearer"
+			}
+			if err != nil || len(parsed) != 1 || !reflect.DeepEqual(parsed[0], want) {
+				t.Errorf("ParseChallenges(%s) = %+v, %v; want %+v", got, parsed, err, want)
+			}
+		})
+	}
+}